@@ -0,0 +1,82 @@
+package pasteburn
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// A blob must come back byte-for-byte on the first read and be gone on the second.
+func TestBlobVerbatimAndBurned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pasteburn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBoltBackedService(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	contents := []byte("\x00opaque client ciphertext\xff")
+
+	d, err := NewBlob(contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostBlob(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.GetBlob(ctx, d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got.Contents, contents) {
+		t.Errorf("Blob came back as %q", got.Contents)
+	}
+
+	if _, err := s.GetBlob(ctx, d.ID); err != ErrBurned {
+		t.Errorf("Expected ErrBurned on the second read, got %v", err)
+	}
+}
+
+// A document the server encrypted must not be downloadable as a blob, which
+// would let anyone with its ID guess the passphrase offline.
+func TestBlobViewRefusesDocuments(t *testing.T) {
+	s := NewDBBackedService(NewMemoryDBService())
+	ctx := context.Background()
+
+	d, err := NewDocumentWithPassphrase([]byte("secret"), []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostDocument(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetBlob(ctx, d.ID); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a passphrase document, got %v", err)
+	}
+	if _, err := s.GetDocument(ctx, d.ID, []byte("hunter2")); err != nil {
+		t.Errorf("Passphrase document was burned by GetBlob: %v", err)
+	}
+
+	b, err := NewBlob([]byte("opaque"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostBlob(ctx, b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetDocument(ctx, b.ID, []byte("hunter2")); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound viewing a blob as a document, got %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+// Command pbkey manages X25519 key pairs for receiving pastes encrypted to a
+// recipient, and decrypts those pastes locally so the private key never
+// leaves this machine.
+//
+//	pbkey generate [-out pasteburn.key]
+//	pbkey public [-key pasteburn.key]
+//	pbkey decrypt [-key pasteburn.key] URL
+//	pbkey decrypt [-key pasteburn.key] -id ID < envelope
+//
+// generate writes a new private key and prints the public key to hand to
+// senders, who pass it as "Recipient" to /api/text/create. decrypt fetches
+// the blob view URL from that response, which burns the paste, or reads an
+// already fetched envelope from standard input.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/graysonchao/pasteburn"
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+const defaultKeyFile = "pasteburn.key"
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	switch os.Args[1] {
+	case "generate":
+		generate(os.Args[2:])
+	case "public":
+		public(os.Args[2:])
+	case "decrypt":
+		decrypt(os.Args[2:])
+	default:
+		usage()
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: pbkey generate|public|decrypt [flags]")
+	os.Exit(2)
+}
+
+func generate(args []string) {
+	fs := flag.NewFlagSet("generate", flag.ExitOnError)
+	out := fs.String("out", defaultKeyFile, "File to write the private key to")
+	fs.Parse(args)
+
+	pub, priv, err := pasteburn.GenerateRecipientKey()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Never overwrite a key, since anything encrypted to it would be lost.
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if _, err := fmt.Fprintln(f, pasteburn.EncodeShareKey(priv)); err != nil {
+		f.Close()
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(pasteburn.EncodeShareKey(pub))
+}
+
+func public(args []string) {
+	fs := flag.NewFlagSet("public", flag.ExitOnError)
+	keyFile := fs.String("key", defaultKeyFile, "Private key file")
+	fs.Parse(args)
+
+	pub, err := pasteburn.RecipientPublicKey(readKey(*keyFile))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fmt.Println(pasteburn.EncodeShareKey(pub))
+}
+
+func decrypt(args []string) {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keyFile := fs.String("key", defaultKeyFile, "Private key file")
+	idFlag := fs.String("id", "", "Paste ID, when reading the envelope from standard input")
+	fs.Parse(args)
+
+	priv := readKey(*keyFile)
+
+	var (
+		rawID    = *idFlag
+		contents []byte
+		err      error
+	)
+	switch fs.NArg() {
+	case 0:
+		if rawID == "" {
+			log.Fatal("-id is required when reading from standard input")
+		}
+		contents, err = ioutil.ReadAll(os.Stdin)
+	case 1:
+		if rawID == "" {
+			u, err := url.Parse(fs.Arg(0))
+			if err != nil {
+				log.Fatal(err)
+			}
+			rawID = u.Query().Get("id")
+		}
+		contents, err = fetch(fs.Arg(0))
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	id, err := uuid.ParseHex(rawID)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	d := &pasteburn.Document{
+		ID:        *id,
+		Contents:  contents,
+		Encrypted: true,
+	}
+	if err := d.DecryptInPlace(priv); err != nil {
+		log.Fatal(err)
+	}
+
+	if d.Metadata.Title != "" {
+		fmt.Fprintln(os.Stderr, "Title:", d.Metadata.Title)
+	}
+	if d.Metadata.Note != "" {
+		fmt.Fprintln(os.Stderr, "Note:", d.Metadata.Note)
+	}
+	os.Stdout.Write(d.Contents)
+}
+
+// readKey reads a private key file written by generate.
+func readKey(path string) []byte {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	key, err := pasteburn.DecodeShareKey(strings.TrimSpace(string(b)))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return key
+}
+
+// fetch returns the body of a blob view response.
+func fetch(u string) ([]byte, error) {
+	res, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
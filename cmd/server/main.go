@@ -3,6 +3,8 @@ package main
 import (
 	"flag"
 	"net/http"
+	"os"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -12,24 +14,100 @@ import (
 
 func main() {
 	var (
-		dbPath = flag.String("dbpath", "./pasteburn.db", "Database path")
+		backend = flag.String("backend", "bolt", "Storage backend (bolt, fs, memory or s3)")
+		dbPath  = flag.String("dbpath", "./pasteburn.db", "Bolt database file, or directory for the fs backend")
+		baseURL = flag.String("baseurl", "", "Public URL used in share links (default: inferred from each request)")
+		maxTTL  = flag.Duration("max-ttl", 7*24*time.Hour, "Longest a document may live unread (0 for no limit)")
+		sweep   = flag.Duration("sweep-interval", time.Minute, "How often expired documents are purged")
+
+		s3Endpoint = flag.String("s3-endpoint", "https://s3.amazonaws.com", "S3-compatible service URL for the s3 backend")
+		s3Region   = flag.String("s3-region", "us-east-1", "Region for the s3 backend")
+		s3Bucket   = flag.String("s3-bucket", "", "Bucket for the s3 backend; credentials come from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+
+		kdf        = flag.String("kdf", "argon2id", "Passphrase KDF for new documents (argon2id or scrypt)")
+		kdfTime    = flag.Uint("kdf-time", uint(pasteburn.DefaultKDFPolicy.Params.Time), "Argon2id passes")
+		kdfMemory  = flag.Uint("kdf-memory", uint(pasteburn.DefaultKDFPolicy.Params.Memory), "Argon2id memory in KiB")
+		kdfThreads = flag.Uint("kdf-threads", uint(pasteburn.DefaultKDFPolicy.Params.Threads), "Argon2id parallelism")
+		kdfLogN    = flag.Uint("kdf-scrypt-logn", uint(pasteburn.DefaultKDFPolicy.Params.LogN), "scrypt cost as log2(N)")
+		kdfMaxTime = flag.Uint("kdf-max-time", uint(pasteburn.DefaultKDFPolicy.Max.Time), "Largest Argon2id passes accepted from a stored document")
+		kdfMaxMem  = flag.Uint("kdf-max-memory", uint(pasteburn.DefaultKDFPolicy.Max.Memory), "Largest Argon2id memory in KiB accepted from a stored document")
+		kdfMaxLogN = flag.Uint("kdf-max-scrypt-logn", uint(pasteburn.DefaultKDFPolicy.Max.LogN), "Largest scrypt log2(N) accepted from a stored document")
 	)
 	flag.Parse()
 
-	s, err := pasteburn.NewBoltBackedService(*dbPath)
+	log.AddHook(pasteburn.RedactHook{})
+
+	switch *kdf {
+	case "argon2id":
+		pasteburn.DefaultKDFPolicy.KDF = pasteburn.KDFArgon2id
+	case "scrypt":
+		pasteburn.DefaultKDFPolicy.KDF = pasteburn.KDFScrypt
+	default:
+		log.Fatalf("Unknown KDF %q", *kdf)
+	}
+	pasteburn.DefaultKDFPolicy.Params.Time = uint32(*kdfTime)
+	pasteburn.DefaultKDFPolicy.Params.Memory = uint32(*kdfMemory)
+	pasteburn.DefaultKDFPolicy.Params.Threads = uint8(*kdfThreads)
+	pasteburn.DefaultKDFPolicy.Params.LogN = uint8(*kdfLogN)
+	pasteburn.DefaultKDFPolicy.Max.Time = uint32(*kdfMaxTime)
+	pasteburn.DefaultKDFPolicy.Max.Memory = uint32(*kdfMaxMem)
+	pasteburn.DefaultKDFPolicy.Max.LogN = uint8(*kdfMaxLogN)
+
+	pasteburn.ShareBaseURL = *baseURL
+
+	// Never let the limits reject documents this server itself just wrote.
+	p := &pasteburn.DefaultKDFPolicy
+	if p.Params.Time > p.Max.Time || p.Params.Memory > p.Max.Memory || p.Params.Threads > p.Max.Threads || p.Params.LogN > p.Max.LogN {
+		log.Fatal("KDF cost for new documents exceeds the configured maximum")
+	}
+
+	var (
+		db  pasteburn.DatabaseService
+		err error
+	)
+	switch *backend {
+	case "bolt":
+		db, err = pasteburn.NewBoltDBService(*dbPath)
+	case "fs":
+		db, err = pasteburn.NewFileDBService(*dbPath)
+	case "memory":
+		db = pasteburn.NewMemoryDBService()
+	case "s3":
+		db = pasteburn.NewS3DBService(&pasteburn.S3ObjectStore{
+			Endpoint:        *s3Endpoint,
+			Region:          *s3Region,
+			Bucket:          *s3Bucket,
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		})
+	default:
+		log.Fatalf("Unknown backend %q", *backend)
+	}
 	if err != nil {
 		panic(err)
 	}
 
+	s := pasteburn.NewDBBackedService(db)
+	defer s.Close()
+	s.MaxTTL = *maxTTL
+
 	log.Info("Starting server...")
 
 	ctx := context.Background()
 
+	go s.Sweep(ctx, *sweep)
+
 	http.HandleFunc("/api/text/view", pasteburn.MakeTextViewHandler(ctx, s))
 	http.HandleFunc("/api/text/create", pasteburn.MakeTextAddHandler(ctx, s))
 	http.HandleFunc("/api/multi/view", pasteburn.MakeMultiTextViewHandler(ctx, s))
 	http.HandleFunc("/api/multi/create", pasteburn.MakeMultiTextAddHandler(ctx, s))
+	http.HandleFunc("/api/multi/combine", pasteburn.MakeMultiCombineHandler(ctx, s))
+	http.HandleFunc("/api/multi/status", pasteburn.MakeMultiStatusHandler(ctx, s))
 	http.HandleFunc("/api/image/view", pasteburn.MakeImageViewHandler(ctx, s))
 	http.HandleFunc("/api/image/create", pasteburn.MakeImageAddHandler(ctx, s))
+	http.HandleFunc("/api/blob/view", pasteburn.MakeBlobViewHandler(ctx, s))
+	http.HandleFunc("/api/blob/create", pasteburn.MakeBlobAddHandler(ctx, s))
+	http.HandleFunc("/api/file/view", pasteburn.MakeFileViewHandler(ctx, s))
+	http.HandleFunc("/api/file/create", pasteburn.MakeFileAddHandler(ctx, s))
 	http.ListenAndServe("127.0.0.1:8080", nil)
 }
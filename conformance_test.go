@@ -0,0 +1,185 @@
+package pasteburn_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/graysonchao/pasteburn"
+	"github.com/graysonchao/pasteburn/dbtest"
+	"golang.org/x/net/context"
+)
+
+// backends returns a constructor for each DatabaseService implementation.
+func backends() map[string]func(t *testing.T) (pasteburn.DatabaseService, func()) {
+	return map[string]func(t *testing.T) (pasteburn.DatabaseService, func()){
+		"bolt": func(t *testing.T) (pasteburn.DatabaseService, func()) {
+			dir, cleanup := tempDir(t)
+			db, err := pasteburn.NewBoltDBService(filepath.Join(dir, "test.db"))
+			if err != nil {
+				cleanup()
+				t.Fatal(err)
+			}
+			return db, cleanup
+		},
+		"fs": func(t *testing.T) (pasteburn.DatabaseService, func()) {
+			dir, cleanup := tempDir(t)
+			db, err := pasteburn.NewFileDBService(dir)
+			if err != nil {
+				cleanup()
+				t.Fatal(err)
+			}
+			return db, cleanup
+		},
+		"memory": func(t *testing.T) (pasteburn.DatabaseService, func()) {
+			return pasteburn.NewMemoryDBService(), func() {}
+		},
+		"s3": func(t *testing.T) (pasteburn.DatabaseService, func()) {
+			return pasteburn.NewS3DBService(pasteburn.NewMemoryObjectStore()), func() {}
+		},
+	}
+}
+
+func tempDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "pasteburn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+// A MultiDoc's body must be deleted with its last copy, whether that copy is
+// burned or expires, leaving nothing behind in storage.
+func TestMultiDocBodyDeleted(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	fs, err := pasteburn.NewFileDBService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+	store := pasteburn.NewMemoryObjectStore()
+
+	stored := map[string]struct {
+		db   pasteburn.DatabaseService
+		left func() (int, error)
+	}{
+		"fs": {fs, func() (int, error) {
+			fis, err := ioutil.ReadDir(filepath.Join(dir, "multidocs"))
+			return len(fis), err
+		}},
+		"s3": {pasteburn.NewS3DBService(store), func() (int, error) {
+			objects, err := store.ListObjects("multidocs/")
+			return len(objects), err
+		}},
+	}
+
+	for name, b := range stored {
+		t.Run(name, func(t *testing.T) {
+			now := time.Now()
+
+			burned, _, err := pasteburn.NewMultiDoc([]byte("secret"), nil, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expired, _, err := pasteburn.NewMultiDoc([]byte("secret"), nil, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expired.Expires = now.Add(time.Minute)
+			for _, md := range []*pasteburn.MultiDoc{burned, expired} {
+				if err := b.db.SaveMultiDoc(md); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, idx := range []uint32{0, 1} {
+				if _, _, err := b.db.LoadMultiDoc(burned.ID, idx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if _, _, err := b.db.LoadMultiDoc(expired.ID, 0); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.db.PurgeExpired(now.Add(2 * time.Minute)); err != nil {
+				t.Fatal(err)
+			}
+
+			if n, err := b.left(); err != nil {
+				t.Fatal(err)
+			} else if n != 0 {
+				t.Errorf("%d MultiDoc entries left in storage", n)
+			}
+		})
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for name, newDB := range backends() {
+		t.Run(name, func(t *testing.T) {
+			dbtest.Run(t, newDB)
+		})
+	}
+}
+
+// However many requests arrive at once, exactly one of them may see the
+// plaintext of a single-read document.
+func TestGetDocumentExactlyOnce(t *testing.T) {
+	const racers = 300
+
+	for name, newDB := range backends() {
+		t.Run(name, func(t *testing.T) {
+			db, cleanup := newDB(t)
+			defer cleanup()
+			s := pasteburn.NewDBBackedService(db)
+			defer s.Close()
+
+			ctx := context.Background()
+			for round := 0; round < 5; round++ {
+				key, _ := pasteburn.GenerateKey()
+				d, err := pasteburn.NewDocument([]byte("secret"), key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := s.PostDocument(ctx, d); err != nil {
+					t.Fatal(err)
+				}
+
+				var (
+					wg      sync.WaitGroup
+					mtx     sync.Mutex
+					winners int
+					start   = make(chan struct{})
+				)
+				for i := 0; i < racers; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						<-start
+
+						got, err := s.GetDocument(ctx, d.ID, key)
+
+						mtx.Lock()
+						defer mtx.Unlock()
+						switch {
+						case err == nil && string(got.Contents) == "secret":
+							winners++
+						case err == pasteburn.ErrBurned:
+						default:
+							t.Errorf("Racing GetDocument returned %v, %v", got, err)
+						}
+					}()
+				}
+				close(start)
+				wg.Wait()
+
+				if winners != 1 {
+					t.Fatalf("%d of %d racing requests got the plaintext", winners, racers)
+				}
+			}
+		})
+	}
+}
@@ -1,83 +1,206 @@
 package pasteburn
 
 import (
-	log "github.com/Sirupsen/logrus"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+
 	"github.com/boltdb/bolt"
 	uuid "github.com/nu7hatch/gouuid"
 )
 
 // DatabaseService defines operations on the backing database.
+// Loads return ErrNotFound, ErrBurned or ErrExpired when there is nothing to read.
+//
+// Every load consumes reads exactly once, however many callers race for the
+// same record: a record saved with Reads = n is returned to exactly n callers,
+// counting callers in any process sharing the storage, and the rest get
+// ErrBurned. A load may only return contents once the read it consumed is
+// durable, so an implementation must claim the read with a single atomic
+// step (a transaction, a lock held across the read and write, or a
+// conditional write) before handing anything back. dbtest.Run checks this.
 type DatabaseService interface {
 	SaveDocument(*Document) error
 	SaveMultiDoc(*MultiDoc) error
 	LoadDocument(id uuid.UUID) (*Document, error)
-	LoadMultiDoc(id uuid.UUID, idx byte) (*Document, error)
+	// SaveBlob and LoadBlob are like SaveDocument and LoadDocument, for
+	// documents the server can't decrypt. Blobs are kept apart from
+	// documents, so neither can be loaded as the other.
+	SaveBlob(*Document) error
+	LoadBlob(id uuid.UUID) (*Document, error)
+	// LoadMultiDoc returns the copy at idx along with the MultiDoc's Body,
+	// which is nil if it has none. The Body is deleted with the last copy,
+	// never before.
+	LoadMultiDoc(id uuid.UUID, idx uint32) (*Document, []byte, error)
+	// PeekMultiDoc returns what LoadMultiDoc would without consuming a
+	// read, so a copy can be checked before it's burned.
+	PeekMultiDoc(id uuid.UUID, idx uint32) (*Document, []byte, error)
+	LoadMultiDocStatus(id uuid.UUID) (*MultiDocStatus, error)
+	SaveStream(d *Document, r io.Reader) error
+	LoadStream(id uuid.UUID) (io.ReadCloser, error)
+	PurgeExpired(now time.Time) (int, error)
+	Close() error
 }
 
 // BoltDBService implements DatabaseService using Bolt.
 // The buckets map contains identifiers for all buckets.
+// It holds the database open for its whole lifetime, so only one
+// BoltDBService may use a given file at a time; call Close when done.
 type BoltDBService struct {
 	dbPath  string
+	db      *bolt.DB
 	buckets map[string][]byte
 }
 
-// NewBoltDBService returns an initialized BoltDBService.
+// boltOpenTimeout bounds how long NewBoltDBService waits for another process
+// to release its lock on the database file.
+const boltOpenTimeout = 5 * time.Second
+
+// NewBoltDBService opens the database at dbPath and returns an initialized BoltDBService.
 func NewBoltDBService(dbPath string) (*BoltDBService, error) {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, err
+	}
+
 	b := &BoltDBService{
 		dbPath: dbPath,
+		db:     db,
 		buckets: map[string][]byte{
-			"documents": []byte("Documents"),
+			"documents":  []byte("Documents"),
+			"multidocs":  []byte("MultiDocs"),
+			"reads":      []byte("Reads"),
+			"expires":    []byte("Expires"),
+			"expiry":     []byte("ExpiryIndex"),
+			"tombstones": []byte("Tombstones"),
+			"statuses":   []byte("Statuses"),
+			"manifests":  []byte("Manifests"),
+			"chunks":     []byte("Chunks"),
 		},
 	}
 	if err := b.initDb(); err != nil {
-		return b, err
+		db.Close()
+		return nil, err
 	}
 	return b, nil
 }
 
+// Close releases the database file.
+func (s *BoltDBService) Close() error {
+	return s.db.Close()
+}
+
 // InitDb sets up the database by creating any buckets specified in the service.
 // Failing to create a bucket is a fatal error and any uncreated buckets at that point
 // will not be created.
-func (s BoltDBService) initDb() error {
-	db, err := bolt.Open(s.dbPath, 0600, nil)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
-	if err := db.Update(func(tx *bolt.Tx) error {
+func (s *BoltDBService) initDb() error {
+	if err := s.db.Update(func(tx *bolt.Tx) error {
 		for _, bn := range s.buckets {
 			_, err := tx.CreateBucketIfNotExists(bn)
 			if err != nil {
 				return err
 			}
 		}
+		return s.migrateMultiDocs(tx)
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// migrateMultiDocs moves MultiDocs saved as top-level buckets, as they were
+// before the MultiDocs bucket existed, into it. Buckets whose copies have all
+// been read are dropped instead.
+func (s *BoltDBService) migrateMultiDocs(tx *bolt.Tx) error {
+	known := make(map[string]bool)
+	for _, bn := range s.buckets {
+		known[string(bn)] = true
+	}
+
+	var legacy [][]byte
+	if err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+		if len(name) == len(uuid.UUID{}) && !known[string(name)] {
+			legacy = append(legacy, append([]byte{}, name...))
+		}
 		return nil
 	}); err != nil {
 		return err
 	}
+
+	for _, key := range legacy {
+		old := tx.Bucket(key)
+		if k, _ := old.Cursor().First(); k == nil {
+			if err := s.clearExpiry(tx, key); err != nil {
+				return err
+			}
+		} else {
+			b, err := tx.Bucket(s.buckets["multidocs"]).CreateBucketIfNotExists(key)
+			if err != nil {
+				return err
+			}
+			if err := old.ForEach(func(k, v []byte) error {
+				return b.Put(append([]byte{}, k...), append([]byte{}, v...))
+			}); err != nil {
+				return err
+			}
+		}
+
+		if err := tx.DeleteBucket(key); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 // LoadDocument returns a Document object loaded from Bolt.
-func (s BoltDBService) LoadDocument(id uuid.UUID) (*Document, error) {
+func (s *BoltDBService) LoadDocument(id uuid.UUID) (*Document, error) {
+	return s.loadDocument(id, id[:])
+}
 
-	db, err := bolt.Open(s.dbPath, 0600, nil)
-	defer db.Close()
+// LoadBlob returns a blob loaded from Bolt.
+func (s *BoltDBService) LoadBlob(id uuid.UUID) (*Document, error) {
+	return s.loadDocument(id, blobKey(id))
+}
 
-	var value []byte
+func (s *BoltDBService) loadDocument(id uuid.UUID, key []byte) (*Document, error) {
+	var (
+		value   []byte
+		loadErr error
+	)
 
-	if err = db.Update(func(tx *bolt.Tx) error {
+	if err := s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(s.buckets["documents"])
+		now := time.Now()
+
+		l := b.Get(key)
+		if l == nil {
+			loadErr = s.tombstoneErr(tx, key)
+			return nil
+		}
+
+		// The deletion has to commit, so report expiry outside the transaction.
+		if s.expired(tx, key, now) {
+			loadErr = ErrExpired
+			return s.deleteDocument(tx, key, tombstoneExpired, now)
+		}
 
-		l := b.Get(id[:])
 		value = make([]byte, len(l))
 		copy(value, l)
 
-		return b.Delete(id[:])
+		burn, err := s.consumeRead(tx, key)
+		if err != nil || !burn {
+			return err
+		}
+
+		return s.deleteDocument(tx, key, tombstoneBurned, now)
 	}); err != nil {
 		return nil, err
 	}
+	if loadErr != nil {
+		return nil, loadErr
+	}
 
 	d := &Document{
 		ID:       id,
@@ -88,52 +211,71 @@ func (s BoltDBService) LoadDocument(id uuid.UUID) (*Document, error) {
 }
 
 // SaveDocument saves a document to the database.
-func (s BoltDBService) SaveDocument(d *Document) error {
-	db, err := bolt.Open(s.dbPath, 0600, nil)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
+func (s *BoltDBService) SaveDocument(d *Document) error {
+	return s.saveDocument(d, append([]byte{}, d.ID[:]...))
+}
 
-	key := make([]byte, len(d.ID))
-	copy(key, d.ID[:])
+// SaveBlob saves a blob to the database.
+func (s *BoltDBService) SaveBlob(d *Document) error {
+	return s.saveDocument(d, blobKey(d.ID))
+}
 
-	if err = db.Update(func(tx *bolt.Tx) error {
+func (s *BoltDBService) saveDocument(d *Document, key []byte) error {
+	if err := s.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(s.buckets["documents"])
-		err = b.Put(key, d.Contents)
-		return err
+		if err := b.Put(key, d.Contents); err != nil {
+			return err
+		}
+		if err := s.putReads(tx, key, d.Reads); err != nil {
+			return err
+		}
+		return s.putExpiry(tx, key, d.Expires, expiryKindDocument)
 	}); err != nil {
-		log.WithField("function", "saveToDb").Fatal(err)
 		return err
 	}
 
 	return nil
 }
 
-// SaveMultiDoc saves a MultiDoc for later retrieval.
-func (s BoltDBService) SaveMultiDoc(md *MultiDoc) error {
-	db, err := bolt.Open(s.dbPath, 0600, nil)
-	if err != nil {
-		return err
-	}
-	defer db.Close()
-
-	if err = db.Update(func(tx *bolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists(md.ID[:])
+// SaveMultiDoc saves a MultiDoc for later retrieval, as a bucket in the
+// MultiDocs bucket holding each copy under its multiDocIndex and the Body
+// under multiDocBodyKey.
+func (s *BoltDBService) SaveMultiDoc(md *MultiDoc) error {
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(s.buckets["multidocs"]).CreateBucketIfNotExists(md.ID[:])
 		if err != nil {
 			return err
 		}
 
+		if md.Body != nil {
+			if err := b.Put(multiDocBodyKey, md.Body); err != nil {
+				return err
+			}
+		}
+
 		for idx, d := range md.Documents {
-			err = b.Put([]byte{idx}, d.Contents)
+			err = b.Put(multiDocIndex(idx), d.Contents)
+			if err != nil {
+				return err
+			}
+			err = s.putReads(tx, multiDocReadsKey(md.ID, idx), md.Reads)
 			if err != nil {
 				return err
 			}
 		}
 
-		return err
+		st, err := newMultiDocStatus(md)
+		if err != nil {
+			return err
+		}
+		if st != nil {
+			if err := s.putStatus(tx, md.ID, st); err != nil {
+				return err
+			}
+		}
+
+		return s.putExpiry(tx, md.ID[:], md.Expires, expiryKindMultiDoc)
 	}); err != nil {
-		log.Fatal(err)
 		return err
 	}
 
@@ -141,26 +283,82 @@ func (s BoltDBService) SaveMultiDoc(md *MultiDoc) error {
 }
 
 // LoadMultiDoc loads the Document at the given idx from a stored MultiDoc.
-func (s BoltDBService) LoadMultiDoc(id uuid.UUID, idx byte) (*Document, error) {
-	db, err := bolt.Open(s.dbPath, 0600, nil)
-	if err != nil {
-		return nil, err
-	}
-	defer db.Close()
+// Burning the last copy deletes the MultiDoc's bucket.
+func (s *BoltDBService) LoadMultiDoc(id uuid.UUID, idx uint32) (*Document, []byte, error) {
+	var (
+		value   []byte
+		body    []byte
+		loadErr error
+	)
 
-	var value []byte
+	copyKey := multiDocReadsKey(id, idx)
 
-	if err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(id[:])
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
 
-		l := b.Get([]byte{idx})
+		multiDocs := tx.Bucket(s.buckets["multidocs"])
+		b := multiDocs.Bucket(id[:])
+		if b == nil {
+			loadErr = s.tombstoneErr(tx, copyKey, id[:])
+			return nil
+		}
+
+		if s.expired(tx, id[:], now) {
+			loadErr = ErrExpired
+			return s.deleteMultiDoc(tx, id[:], now)
+		}
+
+		l := b.Get(multiDocIndex(idx))
+		if l == nil {
+			loadErr = s.tombstoneErr(tx, copyKey)
+			return nil
+		}
 
 		value = make([]byte, len(l))
 		copy(value, l)
+		if v := b.Get(multiDocBodyKey); v != nil {
+			body = make([]byte, len(v))
+			copy(body, v)
+		}
+
+		burn, err := s.consumeRead(tx, copyKey)
+		if err != nil {
+			return err
+		}
+		if err := s.recordRead(tx, copyKey, burn, now); err != nil {
+			return err
+		}
+		if !burn {
+			return nil
+		}
+
+		if err := b.Delete(multiDocIndex(idx)); err != nil {
+			return err
+		}
+		if err := s.putTombstone(tx, copyKey, tombstoneBurned, now); err != nil {
+			return err
+		}
 
-		return b.Delete([]byte{idx})
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if !bytes.Equal(k, multiDocBodyKey) {
+				return nil
+			}
+		}
+		if err := multiDocs.DeleteBucket(id[:]); err != nil {
+			return err
+		}
+		if err := s.updateStatus(tx, id[:], now, func(st *MultiDocStatus) {
+			st.finish(now)
+		}); err != nil {
+			return err
+		}
+		return s.clearExpiry(tx, id[:])
 	}); err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if loadErr != nil {
+		return nil, nil, loadErr
 	}
 
 	d := &Document{
@@ -168,5 +366,478 @@ func (s BoltDBService) LoadMultiDoc(id uuid.UUID, idx byte) (*Document, error) {
 		Contents: value,
 	}
 
-	return d, nil
+	return d, body, nil
+}
+
+// PeekMultiDoc returns the copy at idx of the MultiDoc stored under id and
+// its Body without consuming a read.
+func (s *BoltDBService) PeekMultiDoc(id uuid.UUID, idx uint32) (*Document, []byte, error) {
+	var value, body []byte
+
+	err := s.db.View(func(tx *bolt.Tx) error {
+		copyKey := multiDocReadsKey(id, idx)
+
+		b := tx.Bucket(s.buckets["multidocs"]).Bucket(id[:])
+		if b == nil {
+			return s.tombstoneErr(tx, copyKey, id[:])
+		}
+		if s.expired(tx, id[:], time.Now()) {
+			return ErrExpired
+		}
+		l := b.Get(multiDocIndex(idx))
+		if l == nil {
+			return s.tombstoneErr(tx, copyKey)
+		}
+
+		value = make([]byte, len(l))
+		copy(value, l)
+		if v := b.Get(multiDocBodyKey); v != nil {
+			body = make([]byte, len(v))
+			copy(body, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &Document{
+		ID:       id,
+		Contents: value,
+	}, body, nil
+}
+
+// putReads records how many reads the document stored under key has left.
+// Single-read documents don't get an entry, which is also how documents
+// saved before read counts existed look.
+func (s *BoltDBService) putReads(tx *bolt.Tx, key []byte, reads int) error {
+	if reads <= 1 {
+		return nil
+	}
+
+	v := make([]byte, 4)
+	binary.BigEndian.PutUint32(v, uint32(reads))
+
+	return tx.Bucket(s.buckets["reads"]).Put(key, v)
+}
+
+// consumeRead decrements the read count for key and reports whether that was
+// the last read, in which case the caller must delete the document in the same
+// transaction.
+func (s *BoltDBService) consumeRead(tx *bolt.Tx, key []byte) (bool, error) {
+	b := tx.Bucket(s.buckets["reads"])
+
+	v := b.Get(key)
+	if len(v) != 4 || binary.BigEndian.Uint32(v) <= 1 {
+		return true, b.Delete(key)
+	}
+
+	remaining := make([]byte, 4)
+	binary.BigEndian.PutUint32(remaining, binary.BigEndian.Uint32(v)-1)
+
+	return false, b.Put(key, remaining)
+}
+
+// multiDocReadsKey is the key under which a MultiDoc copy's read count and
+// tombstone are stored. It can't collide with a Document ID, which is always 16 bytes.
+func multiDocReadsKey(id uuid.UUID, idx uint32) []byte {
+	return append(append([]byte{}, id[:]...), multiDocIndex(idx)...)
+}
+
+// blobKey is the key a blob is stored under. It can't collide with a
+// Document ID, a multiDocReadsKey or a multiDocStatusKey.
+func blobKey(id uuid.UUID) []byte {
+	return append(append([]byte{}, id[:]...), "/blob"...)
+}
+
+// multiDocIndex is how a MultiDoc copy index is stored. Indices below 256
+// keep the single byte they had when that was the limit, so MultiDocs saved
+// back then are still found; the rest take 4 bytes, big-endian.
+func multiDocIndex(idx uint32) []byte {
+	if idx < 256 {
+		return []byte{byte(idx)}
+	}
+
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, idx)
+	return b
+}
+
+// parseMultiDocIndex reverses multiDocIndex, reporting false for anything it
+// doesn't produce.
+func parseMultiDocIndex(b []byte) (uint32, bool) {
+	switch len(b) {
+	case 1:
+		return uint32(b[0]), true
+	case 4:
+		idx := binary.BigEndian.Uint32(b)
+		return idx, idx >= 256
+	}
+	return 0, false
+}
+
+// multiDocBodyName is where a MultiDoc's Body is stored alongside its copies.
+// No multiDocIndex is 6 bytes long, nor is "shared" valid hex, so it can't be
+// mistaken for one by any backend.
+const multiDocBodyName = "shared"
+
+var multiDocBodyKey = []byte(multiDocBodyName)
+
+// Expiry index entries record what kind of record they point at so the
+// sweeper knows how to delete it.
+const (
+	expiryKindDocument  byte = 'd'
+	expiryKindMultiDoc  byte = 'm'
+	expiryKindTombstone byte = 't'
+)
+
+// Tombstones remember why a record is gone so loads can tell a burned or
+// expired document apart from one that never existed. They are themselves
+// swept after tombstoneTTL.
+const (
+	tombstoneBurned  byte = 'b'
+	tombstoneExpired byte = 'x'
+
+	tombstoneTTL = 7 * 24 * time.Hour
+)
+
+// putExpiry records when the record stored under key expires. The Expires
+// bucket maps key to its deadline for lookups, and the ExpiryIndex bucket
+// orders deadline||key so the sweeper can walk expired records in order.
+func (s *BoltDBService) putExpiry(tx *bolt.Tx, key []byte, expires time.Time, kind byte) error {
+	if expires.IsZero() {
+		return nil
+	}
+
+	deadline := make([]byte, 8)
+	binary.BigEndian.PutUint64(deadline, uint64(expires.UnixNano()))
+
+	if err := tx.Bucket(s.buckets["expires"]).Put(key, deadline); err != nil {
+		return err
+	}
+
+	return tx.Bucket(s.buckets["expiry"]).Put(append(deadline, key...), []byte{kind})
+}
+
+// expired reports whether the record stored under key has passed its deadline.
+func (s *BoltDBService) expired(tx *bolt.Tx, key []byte, now time.Time) bool {
+	deadline := tx.Bucket(s.buckets["expires"]).Get(key)
+	if len(deadline) != 8 {
+		return false
+	}
+	return int64(binary.BigEndian.Uint64(deadline)) <= now.UnixNano()
+}
+
+// clearExpiry removes both expiry entries for key.
+func (s *BoltDBService) clearExpiry(tx *bolt.Tx, key []byte) error {
+	expires := tx.Bucket(s.buckets["expires"])
+
+	deadline := expires.Get(key)
+	if deadline == nil {
+		return nil
+	}
+
+	indexKey := append(append([]byte{}, deadline...), key...)
+	if err := tx.Bucket(s.buckets["expiry"]).Delete(indexKey); err != nil {
+		return err
+	}
+
+	return expires.Delete(key)
+}
+
+// putTombstone records that the record under key was removed at now for reason.
+// The value is the reason byte followed by the removal time in nanoseconds.
+func (s *BoltDBService) putTombstone(tx *bolt.Tx, key []byte, reason byte, now time.Time) error {
+	v := make([]byte, 9)
+	v[0] = reason
+	binary.BigEndian.PutUint64(v[1:], uint64(now.UnixNano()))
+
+	if err := tx.Bucket(s.buckets["tombstones"]).Put(key, v); err != nil {
+		return err
+	}
+
+	return s.putExpiry(tx, key, now.Add(tombstoneTTL), expiryKindTombstone)
+}
+
+// tombstoneErr returns the error explaining why there's nothing stored under
+// the first of keys that has a tombstone, or ErrNotFound if none do.
+func (s *BoltDBService) tombstoneErr(tx *bolt.Tx, keys ...[]byte) error {
+	b := tx.Bucket(s.buckets["tombstones"])
+	for _, key := range keys {
+		v := b.Get(key)
+		if len(v) != 9 {
+			continue
+		}
+		if err := tombstoneReasonErr(v[0]); err != ErrNotFound {
+			return err
+		}
+	}
+	return ErrNotFound
+}
+
+// tombstoneReasonErr returns the load error for a tombstone's reason byte.
+func tombstoneReasonErr(reason byte) error {
+	switch reason {
+	case tombstoneBurned:
+		return ErrBurned
+	case tombstoneExpired:
+		return ErrExpired
+	}
+	return ErrNotFound
+}
+
+// deleteTombstone removes a tombstone once it has outlived tombstoneTTL.
+func (s *BoltDBService) deleteTombstone(tx *bolt.Tx, key []byte) error {
+	if err := tx.Bucket(s.buckets["tombstones"]).Delete(key); err != nil {
+		return err
+	}
+	return s.clearExpiry(tx, key)
+}
+
+// deleteDocument removes a document and everything stored about it,
+// leaving a tombstone that records reason.
+func (s *BoltDBService) deleteDocument(tx *bolt.Tx, key []byte, reason byte, now time.Time) error {
+	if err := tx.Bucket(s.buckets["documents"]).Delete(key); err != nil {
+		return err
+	}
+	if err := tx.Bucket(s.buckets["reads"]).Delete(key); err != nil {
+		return err
+	}
+	if err := s.clearExpiry(tx, key); err != nil {
+		return err
+	}
+	return s.putTombstone(tx, key, reason, now)
+}
+
+// deleteMultiDoc removes an expired MultiDoc's bucket and everything stored
+// about its copies, leaving a tombstone for the whole set.
+func (s *BoltDBService) deleteMultiDoc(tx *bolt.Tx, key []byte, now time.Time) error {
+	multiDocs := tx.Bucket(s.buckets["multidocs"])
+	if b := multiDocs.Bucket(key); b != nil {
+		var copies [][]byte
+		if err := b.ForEach(func(k, v []byte) error {
+			if !bytes.Equal(k, multiDocBodyKey) {
+				copies = append(copies, append([]byte{}, k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, idx := range copies {
+			readsKey := append(append([]byte{}, key...), idx...)
+			if err := tx.Bucket(s.buckets["reads"]).Delete(readsKey); err != nil {
+				return err
+			}
+		}
+
+		if err := multiDocs.DeleteBucket(key); err != nil {
+			return err
+		}
+	}
+
+	if err := s.updateStatus(tx, key, now, func(st *MultiDocStatus) {
+		st.expire(now)
+	}); err != nil {
+		return err
+	}
+
+	if err := s.clearExpiry(tx, key); err != nil {
+		return err
+	}
+	return s.putTombstone(tx, key, tombstoneExpired, now)
+}
+
+// LoadMultiDocStatus returns the status of the MultiDoc stored under id, or
+// ErrNotFound if it wasn't saved with a status token or the status is gone.
+// The status is kept in the Statuses bucket under its multiDocStatusKey and
+// each copy's under its multiDocReadsKey, so they're all found by prefix.
+func (s *BoltDBService) LoadMultiDocStatus(id uuid.UUID) (*MultiDocStatus, error) {
+	var st *MultiDocStatus
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.buckets["statuses"])
+		v := b.Get(multiDocStatusKey(id[:]))
+		if v == nil {
+			return ErrNotFound
+		}
+
+		var err error
+		if st, err = parseMultiDocStatus(v); err != nil {
+			return err
+		}
+
+		c := b.Cursor()
+		for k, v := c.Seek(id[:]); k != nil && bytes.HasPrefix(k, id[:]); k, v = c.Next() {
+			idx, ok := parseMultiDocIndex(k[len(id):])
+			if !ok {
+				continue
+			}
+			if st.Copies[idx], err = parseCopyStatus(v); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// putStatus stores a new status for the MultiDoc id, and that of each of
+// its copies.
+func (s *BoltDBService) putStatus(tx *bolt.Tx, id uuid.UUID, st *MultiDocStatus) error {
+	b := tx.Bucket(s.buckets["statuses"])
+
+	v, err := st.marshal()
+	if err != nil {
+		return err
+	}
+	if err := b.Put(multiDocStatusKey(id[:]), v); err != nil {
+		return err
+	}
+
+	for idx, c := range st.Copies {
+		v, err := c.marshal()
+		if err != nil {
+			return err
+		}
+		if err := b.Put(multiDocReadsKey(id, idx), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordRead records a read of the copy whose multiDocReadsKey is
+// copyKey in its status, if the MultiDoc has one.
+func (s *BoltDBService) recordRead(tx *bolt.Tx, copyKey []byte, burned bool, now time.Time) error {
+	b := tx.Bucket(s.buckets["statuses"])
+
+	v := b.Get(copyKey)
+	if v == nil {
+		return nil
+	}
+	c, err := parseCopyStatus(v)
+	if err != nil {
+		return err
+	}
+
+	c.read(burned, now)
+
+	if v, err = c.marshal(); err != nil {
+		return err
+	}
+	return b.Put(copyKey, v)
+}
+
+// updateStatus applies update to the status of the MultiDoc stored under key,
+// if it has one. Once the status is finished it's scheduled for deletion
+// after tombstoneTTL.
+func (s *BoltDBService) updateStatus(tx *bolt.Tx, key []byte, now time.Time, update func(*MultiDocStatus)) error {
+	b := tx.Bucket(s.buckets["statuses"])
+	statusKey := multiDocStatusKey(key)
+
+	v := b.Get(statusKey)
+	if v == nil {
+		return nil
+	}
+	st, err := parseMultiDocStatus(v)
+	if err != nil {
+		return err
+	}
+
+	finished := !st.Finished.IsZero()
+	update(st)
+
+	if v, err = st.marshal(); err != nil {
+		return err
+	}
+	if err := b.Put(statusKey, v); err != nil {
+		return err
+	}
+
+	if finished || st.Finished.IsZero() {
+		return nil
+	}
+	return s.putExpiry(tx, statusKey, st.Finished.Add(tombstoneTTL), expiryKindStatus)
+}
+
+// deleteStatus deletes the status stored under statusKey along with those of
+// the MultiDoc's copies.
+func (s *BoltDBService) deleteStatus(tx *bolt.Tx, statusKey []byte) error {
+	id := statusKey[:len(statusKey)-len("status")]
+
+	var keys [][]byte
+	c := tx.Bucket(s.buckets["statuses"]).Cursor()
+	for k, _ := c.Seek(id); k != nil && bytes.HasPrefix(k, id); k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+
+	for _, k := range keys {
+		if err := tx.Bucket(s.buckets["statuses"]).Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeExpired deletes every document and MultiDoc whose deadline is at or
+// before now, returning how many were removed. Stale tombstones and
+// MultiDoc statuses are dropped too but aren't counted.
+func (s *BoltDBService) PurgeExpired(now time.Time) (int, error) {
+	purged := 0
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		limit := make([]byte, 8)
+		binary.BigEndian.PutUint64(limit, uint64(now.UnixNano()))
+
+		type entry struct {
+			key  []byte
+			kind byte
+		}
+		var expired []entry
+
+		c := tx.Bucket(s.buckets["expiry"]).Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k[:8], limit) <= 0; k, v = c.Next() {
+			if len(v) != 1 {
+				continue
+			}
+			expired = append(expired, entry{
+				key:  append([]byte{}, k[8:]...),
+				kind: v[0],
+			})
+		}
+
+		for _, e := range expired {
+			var err error
+			switch e.kind {
+			case expiryKindDocument:
+				err = s.deleteDocument(tx, e.key, tombstoneExpired, now)
+				purged++
+			case expiryKindMultiDoc:
+				err = s.deleteMultiDoc(tx, e.key, now)
+				purged++
+			case expiryKindStream:
+				err = s.deleteStream(tx, e.key, tombstoneExpired, now)
+				purged++
+			case expiryKindTombstone:
+				err = s.deleteTombstone(tx, e.key)
+			case expiryKindStatus:
+				if err = s.deleteStatus(tx, e.key); err == nil {
+					err = s.clearExpiry(tx, e.key)
+				}
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		return s.purgeOrphanChunks(tx, now)
+	}); err != nil {
+		return 0, err
+	}
+
+	return purged, nil
 }
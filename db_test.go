@@ -0,0 +1,326 @@
+package pasteburn
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// newTestBoltDBService returns a BoltDBService in a temporary directory and a func to remove it.
+func newTestBoltDBService(t testing.TB) (*BoltDBService, func()) {
+	dir, err := ioutil.TempDir("", "pasteburn")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewBoltDBService(filepath.Join(dir, "test.db"))
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// A document saved with Reads = n must be readable exactly n times.
+func TestBoltReadsCountdown(t *testing.T) {
+	db, cleanup := newTestBoltDBService(t)
+	defer cleanup()
+
+	d, err := NewBlob([]byte("ciphertext"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Reads = 3
+
+	if err := db.SaveDocument(d); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		got, err := db.LoadDocument(d.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got.Contents) != "ciphertext" {
+			t.Fatalf("Read %d returned %q", i+1, got.Contents)
+		}
+	}
+
+	if _, err := db.LoadDocument(d.ID); err != ErrBurned {
+		t.Errorf("Expected ErrBurned after the last read, got %v", err)
+	}
+}
+
+func TestBoltMultiDocReadsPerCopy(t *testing.T) {
+	db, cleanup := newTestBoltDBService(t)
+	defer cleanup()
+
+	md, _, err := NewMultiDoc([]byte("secret"), nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md.Reads = 2
+
+	if err := db.SaveMultiDoc(md); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, idx := range []uint32{0, 0, 1, 1} {
+		got, _, err := db.LoadMultiDoc(md.ID, idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Contents) == 0 {
+			t.Fatalf("Copy %d burned early", idx)
+		}
+	}
+
+	for _, idx := range []uint32{0, 1} {
+		if _, _, err := db.LoadMultiDoc(md.ID, idx); err != ErrBurned {
+			t.Errorf("Expected ErrBurned for copy %d, got %v", idx, err)
+		}
+	}
+}
+
+// An expired document must be unreadable even before the sweeper gets to it.
+func TestBoltExpiredAtLookup(t *testing.T) {
+	db, cleanup := newTestBoltDBService(t)
+	defer cleanup()
+
+	d, err := NewBlob([]byte("ciphertext"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Expires = time.Now().Add(-time.Second)
+
+	if err := db.SaveDocument(d); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.LoadDocument(d.ID); err != ErrExpired {
+		t.Errorf("Expected ErrExpired, got %v", err)
+	}
+	if _, err := db.LoadDocument(d.ID); err != ErrExpired {
+		t.Errorf("Expected ErrExpired on the second read, got %v", err)
+	}
+}
+
+func TestBoltPurgeExpired(t *testing.T) {
+	db, cleanup := newTestBoltDBService(t)
+	defer cleanup()
+
+	now := time.Now()
+
+	expired, _ := NewBlob([]byte("expired"))
+	expired.Expires = now.Add(time.Minute)
+	live, _ := NewBlob([]byte("live"))
+	live.Expires = now.Add(time.Hour)
+	md, _, err := NewMultiDoc([]byte("secret"), nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md.Expires = now.Add(time.Minute)
+
+	for _, d := range []*Document{expired, live} {
+		if err := db.SaveDocument(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SaveMultiDoc(md); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := db.PurgeExpired(now.Add(2 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Purged %d records, expected 2", n)
+	}
+
+	got, err := db.LoadDocument(live.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Contents) != "live" {
+		t.Error("Unexpired document was purged")
+	}
+
+	db.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(db.buckets["multidocs"]).Bucket(md.ID[:]) != nil {
+			t.Error("Expired MultiDoc bucket was not purged")
+		}
+		tx.Bucket(db.buckets["expiry"]).ForEach(func(k, v []byte) error {
+			if v[0] != expiryKindTombstone {
+				t.Errorf("Expiry index still has a %q entry", v[0])
+			}
+			return nil
+		})
+		return nil
+	})
+
+	if _, _, err := db.LoadMultiDoc(md.ID, 0); err != ErrExpired {
+		t.Errorf("Expected ErrExpired for a purged MultiDoc, got %v", err)
+	}
+
+	// Tombstones are swept once they've outlived their usefulness.
+	if _, err := db.PurgeExpired(now.Add(tombstoneTTL + time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.LoadDocument(expired.ID); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound once the tombstone is swept, got %v", err)
+	}
+}
+
+// Reading the last copy of a MultiDoc removes its bucket and its expiry.
+func TestBoltMultiDocCleanup(t *testing.T) {
+	db, cleanup := newTestBoltDBService(t)
+	defer cleanup()
+
+	md, _, err := NewMultiDoc([]byte("secret"), nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md.Expires = time.Now().Add(time.Hour)
+	if err := db.SaveMultiDoc(md); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, idx := range []uint32{0, 1} {
+		if _, _, err := db.LoadMultiDoc(md.ID, idx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(db.buckets["multidocs"]).Bucket(md.ID[:]) != nil {
+			t.Error("Burned MultiDoc bucket was not deleted")
+		}
+		if tx.Bucket(db.buckets["expires"]).Get(md.ID[:]) != nil {
+			t.Error("Burned MultiDoc still has a deadline")
+		}
+		return nil
+	})
+
+	for _, idx := range []uint32{0, 1} {
+		if _, _, err := db.LoadMultiDoc(md.ID, idx); err != ErrBurned {
+			t.Errorf("Expected ErrBurned for copy %d, got %v", idx, err)
+		}
+	}
+}
+
+// MultiDocs saved as top-level buckets are moved into the MultiDocs bucket
+// when the database is opened, and empty ones are dropped.
+func TestBoltMultiDocMigration(t *testing.T) {
+	db, cleanup := newTestBoltDBService(t)
+	defer cleanup()
+
+	live, _ := uuid.NewV4()
+	burned, _ := uuid.NewV4()
+	if err := db.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket(live[:])
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte{1}, []byte("copy")); err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket(burned[:])
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+	db, err := NewBoltDBService(db.dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	db.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(live[:]) != nil || tx.Bucket(burned[:]) != nil {
+			t.Error("Top-level MultiDoc buckets were not removed")
+		}
+		if tx.Bucket(db.buckets["multidocs"]).Bucket(burned[:]) != nil {
+			t.Error("Empty MultiDoc bucket was migrated")
+		}
+		return nil
+	})
+
+	got, _, err := db.LoadMultiDoc(*live, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Contents) != "copy" {
+		t.Errorf("Migrated copy loaded as %q", got.Contents)
+	}
+}
+
+func TestBoltNotFound(t *testing.T) {
+	db, cleanup := newTestBoltDBService(t)
+	defer cleanup()
+
+	d, err := NewBlob([]byte("ciphertext"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.LoadDocument(d.ID); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing document, got %v", err)
+	}
+	if _, _, err := db.LoadMultiDoc(d.ID, 0); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a missing MultiDoc, got %v", err)
+	}
+}
+
+func BenchmarkBoltParallelCreate(b *testing.B) {
+	db, cleanup := newTestBoltDBService(b)
+	defer cleanup()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			d, err := NewBlob([]byte("ciphertext"))
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if err := db.SaveDocument(d); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func BenchmarkBoltParallelCreateView(b *testing.B) {
+	db, cleanup := newTestBoltDBService(b)
+	defer cleanup()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			d, err := NewBlob([]byte("ciphertext"))
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			if err := db.SaveDocument(d); err != nil {
+				b.Error(err)
+				return
+			}
+			if _, err := db.LoadDocument(d.ID); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,363 @@
+package pasteburn
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/boltdb/bolt"
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// Large documents are stored as a manifest in the Manifests bucket plus a
+// nested bucket per document in the Chunks bucket holding fixed-size chunks
+// keyed by their 8 byte big endian sequence number. Each chunk is written in
+// its own transaction, so an upload never holds more than one chunk in memory.
+//
+// Besides the chunks, a document's chunk bucket has bookkeeping keys:
+//
+//	"t"  last activity time, used to sweep uploads and reads that were abandoned
+//	"r"  number of readers currently streaming the chunks
+//	"b"  present once the document has burned
+//
+// Burning deletes the manifest in the same transaction that consumes the last
+// read, so no later load can succeed. The chunks themselves are deleted with
+// the whole bucket once the last reader streaming them closes.
+
+// boltChunkSize is the size of every stored chunk except the last.
+const boltChunkSize = 1 << 20
+
+// orphanTTL is how long a chunk bucket without a manifest may sit idle before
+// it's assumed to belong to a failed upload or a reader that never closed.
+const orphanTTL = time.Hour
+
+// touchEvery is how many chunks a reader streams between activity updates, so
+// slow downloads of burned streams aren't mistaken for abandoned ones.
+const touchEvery = 64
+
+const expiryKindStream byte = 's'
+
+var (
+	chunkKeyActivity = []byte("t")
+	chunkKeyReaders  = []byte("r")
+	chunkKeyBurned   = []byte("b")
+)
+
+// streamManifest describes a stored stream.
+type streamManifest struct {
+	Size   uint64
+	Chunks uint64
+}
+
+func (m streamManifest) marshal() []byte {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b, m.Size)
+	binary.BigEndian.PutUint64(b[8:], m.Chunks)
+	return b
+}
+
+func parseStreamManifest(b []byte) (streamManifest, error) {
+	if len(b) != 16 {
+		return streamManifest{}, errors.New("malformed stream manifest")
+	}
+	return streamManifest{
+		Size:   binary.BigEndian.Uint64(b),
+		Chunks: binary.BigEndian.Uint64(b[8:]),
+	}, nil
+}
+
+func chunkKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+func timeValue(t time.Time) []byte {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(t.UnixNano()))
+	return v
+}
+
+// SaveStream stores everything read from r under d.ID, honoring d.Reads and
+// d.Expires. d.Contents is ignored. The stream only becomes readable once r
+// is exhausted; if anything fails first, the chunks written so far are removed.
+func (s *BoltDBService) SaveStream(d *Document, r io.Reader) error {
+	key := append([]byte{}, d.ID[:]...)
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(s.buckets["manifests"]).Get(key) != nil {
+			return errors.New("stream already exists")
+		}
+		b, err := tx.Bucket(s.buckets["chunks"]).CreateBucket(key)
+		if err != nil {
+			return err
+		}
+		return b.Put(chunkKeyActivity, timeValue(time.Now()))
+	}); err != nil {
+		return err
+	}
+
+	m, err := s.writeChunks(key, r)
+	if err == nil {
+		err = s.db.Update(func(tx *bolt.Tx) error {
+			if err := tx.Bucket(s.buckets["manifests"]).Put(key, m.marshal()); err != nil {
+				return err
+			}
+			if err := s.putReads(tx, key, d.Reads); err != nil {
+				return err
+			}
+			return s.putExpiry(tx, key, d.Expires, expiryKindStream)
+		})
+	}
+	if err != nil {
+		s.db.Update(func(tx *bolt.Tx) error {
+			return tx.Bucket(s.buckets["chunks"]).DeleteBucket(key)
+		})
+		return err
+	}
+
+	return nil
+}
+
+func (s *BoltDBService) writeChunks(key []byte, r io.Reader) (streamManifest, error) {
+	var m streamManifest
+	buf := make([]byte, boltChunkSize)
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := s.db.Update(func(tx *bolt.Tx) error {
+				b := tx.Bucket(s.buckets["chunks"]).Bucket(key)
+				if err := b.Put(chunkKey(m.Chunks), buf[:n]); err != nil {
+					return err
+				}
+				return b.Put(chunkKeyActivity, timeValue(time.Now()))
+			}); err != nil {
+				return m, err
+			}
+			m.Size += uint64(n)
+			m.Chunks++
+		}
+
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			return m, nil
+		default:
+			return m, err
+		}
+	}
+}
+
+// LoadStream consumes one read of the stream stored under id and returns a
+// reader of its contents, which must be closed. Errors are the same as
+// LoadDocument's.
+func (s *BoltDBService) LoadStream(id uuid.UUID) (io.ReadCloser, error) {
+	key := append([]byte{}, id[:]...)
+
+	var (
+		m       streamManifest
+		loadErr error
+	)
+
+	if err := s.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now()
+
+		v := tx.Bucket(s.buckets["manifests"]).Get(key)
+		if v == nil {
+			loadErr = s.tombstoneErr(tx, key)
+			return nil
+		}
+
+		if s.expired(tx, key, now) {
+			loadErr = ErrExpired
+			return s.deleteStream(tx, key, tombstoneExpired, now)
+		}
+
+		var err error
+		if m, err = parseStreamManifest(v); err != nil {
+			return err
+		}
+
+		chunks := tx.Bucket(s.buckets["chunks"]).Bucket(key)
+		if chunks == nil {
+			return errors.New("stream chunks are missing")
+		}
+		if err := adjustReaders(chunks, 1); err != nil {
+			return err
+		}
+		if err := chunks.Put(chunkKeyActivity, timeValue(now)); err != nil {
+			return err
+		}
+
+		burn, err := s.consumeRead(tx, key)
+		if err != nil || !burn {
+			return err
+		}
+
+		return s.deleteStream(tx, key, tombstoneBurned, now)
+	}); err != nil {
+		return nil, err
+	}
+	if loadErr != nil {
+		return nil, loadErr
+	}
+
+	return &boltChunkReader{
+		s:        s,
+		key:      key,
+		manifest: m,
+	}, nil
+}
+
+// deleteStream removes a stream's manifest and bookkeeping, leaving a
+// tombstone. Its chunk bucket goes too unless a reader is still streaming it,
+// in which case the last reader to close deletes it.
+func (s *BoltDBService) deleteStream(tx *bolt.Tx, key []byte, reason byte, now time.Time) error {
+	if err := tx.Bucket(s.buckets["manifests"]).Delete(key); err != nil {
+		return err
+	}
+	if err := tx.Bucket(s.buckets["reads"]).Delete(key); err != nil {
+		return err
+	}
+	if err := s.clearExpiry(tx, key); err != nil {
+		return err
+	}
+
+	chunks := tx.Bucket(s.buckets["chunks"])
+	if b := chunks.Bucket(key); b != nil {
+		if readers(b) == 0 {
+			if err := chunks.DeleteBucket(key); err != nil {
+				return err
+			}
+		} else if err := b.Put(chunkKeyBurned, []byte{1}); err != nil {
+			return err
+		}
+	}
+
+	return s.putTombstone(tx, key, reason, now)
+}
+
+// purgeOrphanChunks deletes chunk buckets that have no manifest and have been
+// idle longer than orphanTTL.
+func (s *BoltDBService) purgeOrphanChunks(tx *bolt.Tx, now time.Time) error {
+	chunks := tx.Bucket(s.buckets["chunks"])
+	manifests := tx.Bucket(s.buckets["manifests"])
+
+	var orphans [][]byte
+	if err := chunks.ForEach(func(k, v []byte) error {
+		if v != nil || manifests.Get(k) != nil {
+			return nil
+		}
+		t := chunks.Bucket(k).Get(chunkKeyActivity)
+		if len(t) == 8 && now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(t)))) < orphanTTL {
+			return nil
+		}
+		orphans = append(orphans, append([]byte{}, k...))
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, k := range orphans {
+		if err := chunks.DeleteBucket(k); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func readers(b *bolt.Bucket) uint64 {
+	v := b.Get(chunkKeyReaders)
+	if len(v) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(v)
+}
+
+func adjustReaders(b *bolt.Bucket, delta int) error {
+	n := int64(readers(b)) + int64(delta)
+	if n < 0 {
+		n = 0
+	}
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(n))
+	return b.Put(chunkKeyReaders, v)
+}
+
+// boltChunkReader streams a stored stream one chunk per read transaction.
+type boltChunkReader struct {
+	s        *BoltDBService
+	key      []byte
+	manifest streamManifest
+	next     uint64
+	chunk    []byte
+	closed   bool
+}
+
+func (r *boltChunkReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, errors.New("read from closed stream")
+	}
+
+	for len(r.chunk) == 0 {
+		if r.next >= r.manifest.Chunks {
+			return 0, io.EOF
+		}
+
+		read := r.s.db.View
+		if r.next > 0 && r.next%touchEvery == 0 {
+			read = r.s.db.Update
+		}
+
+		if err := read(func(tx *bolt.Tx) error {
+			b := tx.Bucket(r.s.buckets["chunks"]).Bucket(r.key)
+			if b == nil {
+				return errors.New("stream chunks are missing")
+			}
+			v := b.Get(chunkKey(r.next))
+			if v == nil {
+				return errors.New("stream chunk is missing")
+			}
+			r.chunk = append([]byte{}, v...)
+			if tx.Writable() {
+				return b.Put(chunkKeyActivity, timeValue(time.Now()))
+			}
+			return nil
+		}); err != nil {
+			return 0, err
+		}
+		r.next++
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+
+	return n, nil
+}
+
+// Close releases the reader's hold on the chunks, deleting them if the stream
+// has burned and this was the last reader.
+func (r *boltChunkReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+
+	return r.s.db.Update(func(tx *bolt.Tx) error {
+		chunks := tx.Bucket(r.s.buckets["chunks"])
+		b := chunks.Bucket(r.key)
+		if b == nil {
+			return nil
+		}
+		if err := adjustReaders(b, -1); err != nil {
+			return err
+		}
+		if readers(b) == 0 && b.Get(chunkKeyBurned) != nil {
+			return chunks.DeleteBucket(r.key)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,159 @@
+package pasteburn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	uuid "github.com/nu7hatch/gouuid"
+	"golang.org/x/net/context"
+)
+
+func chunkBucketExists(t *testing.T, db *BoltDBService, id uuid.UUID) bool {
+	var exists bool
+	if err := db.db.View(func(tx *bolt.Tx) error {
+		exists = tx.Bucket(db.buckets["chunks"]).Bucket(id[:]) != nil
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+// A stream spanning several chunks must read back intact, and a reader that's
+// still open when the stream burns must be able to finish.
+func TestBoltStreamChunks(t *testing.T) {
+	db, cleanup := newTestBoltDBService(t)
+	defer cleanup()
+
+	contents := make([]byte, 2*boltChunkSize+123)
+	rand.Read(contents)
+
+	id, _ := uuid.NewV4()
+	d := &Document{ID: *id, Reads: 2}
+	if err := db.SaveStream(d, bytes.NewReader(contents)); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := db.LoadStream(d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := db.LoadStream(d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.LoadStream(d.ID); err != ErrBurned {
+		t.Errorf("Expected ErrBurned after the last read, got %v", err)
+	}
+
+	for i, r := range []io.ReadCloser{first, last} {
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, contents) {
+			t.Errorf("Reader %d got %d bytes, expected %d", i, len(got), len(contents))
+		}
+		if !chunkBucketExists(t, db, d.ID) {
+			t.Fatalf("Chunks were deleted while reader %d was open", i)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if chunkBucketExists(t, db, d.ID) {
+		t.Error("Chunks outlived the last reader of a burned stream")
+	}
+}
+
+// Chunks from an upload that never finished must be swept once they go idle.
+func TestBoltStreamOrphans(t *testing.T) {
+	db, cleanup := newTestBoltDBService(t)
+	defer cleanup()
+
+	id, _ := uuid.NewV4()
+	if err := db.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(db.buckets["chunks"]).CreateBucket(id[:])
+		if err != nil {
+			return err
+		}
+		if err := b.Put(chunkKey(0), []byte("partial")); err != nil {
+			return err
+		}
+		return b.Put(chunkKeyActivity, timeValue(time.Now()))
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.PurgeExpired(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if !chunkBucketExists(t, db, *id) {
+		t.Fatal("Purged chunks of an upload that may still be in progress")
+	}
+
+	if _, err := db.PurgeExpired(time.Now().Add(orphanTTL + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if chunkBucketExists(t, db, *id) {
+		t.Error("Orphaned chunks weren't purged")
+	}
+}
+
+func TestStreamService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pasteburn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBoltBackedService(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	key := []byte("11112222333344445555666677778888")
+	contents := make([]byte, 3*StreamSegmentSize+5)
+	rand.Read(contents)
+
+	for _, tc := range []struct {
+		key []byte
+		err error
+	}{
+		{key, nil},
+		{[]byte("88887777666655554444333322221111"), ErrDecrypt},
+	} {
+		id, _ := uuid.NewV4()
+		d := &Document{ID: *id, Reads: 1}
+		if err := s.PostStream(ctx, d, bytes.NewReader(encryptStream(t, d.ID, key, contents))); err != nil {
+			t.Fatal(err)
+		}
+
+		_, r, err := s.GetStream(ctx, d.ID, tc.key)
+		if err != tc.err {
+			t.Fatalf("Expected %v, got %v", tc.err, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, contents) {
+			t.Error("Stream contents changed in storage")
+		}
+	}
+}
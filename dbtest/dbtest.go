@@ -0,0 +1,560 @@
+// Package dbtest is a conformance suite for pasteburn.DatabaseService
+// implementations. Call Run from a test with a constructor for the backend.
+package dbtest
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/graysonchao/pasteburn"
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// Racers is how many goroutines the concurrency tests use to read the same record.
+var Racers = 200
+
+// Run runs every conformance test against a fresh DatabaseService from newDB,
+// which also returns a func that releases anything newDB created. The
+// DatabaseService is closed before that func is called.
+func Run(t *testing.T, newDB func(t *testing.T) (pasteburn.DatabaseService, func())) {
+	tests := []struct {
+		name string
+		test func(*testing.T, pasteburn.DatabaseService)
+	}{
+		{"RoundTrip", testRoundTrip},
+		{"BurnOnRead", testBurnOnRead},
+		{"ReadsCountdown", testReadsCountdown},
+		{"NotFound", testNotFound},
+		{"BlobsApart", testBlobsApart},
+		{"MultiDocPerIndex", testMultiDocPerIndex},
+		{"MultiDocAllBurned", testMultiDocAllBurned},
+		{"MultiDocManyCopies", testMultiDocManyCopies},
+		{"MultiDocStatus", testMultiDocStatus},
+		{"ExpiredAtLookup", testExpiredAtLookup},
+		{"PurgeExpired", testPurgeExpired},
+		{"Stream", testStream},
+		{"ConcurrentReaders", testConcurrentReaders},
+		{"ConcurrentMultiDocReaders", testConcurrentMultiDocReaders},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			db, cleanup := newDB(t)
+			defer cleanup()
+			defer db.Close()
+
+			tc.test(t, db)
+		})
+	}
+}
+
+func newBlob(t *testing.T, contents string) *pasteburn.Document {
+	d, err := pasteburn.NewBlob([]byte(contents))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func save(t *testing.T, db pasteburn.DatabaseService, d *pasteburn.Document) {
+	if err := db.SaveDocument(d); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Contents must come back byte for byte, and saving must copy them.
+func testRoundTrip(t *testing.T, db pasteburn.DatabaseService) {
+	contents := []byte("\x00ciphertext\xff")
+	d := newBlob(t, string(contents))
+	save(t, db, d)
+	d.Contents[0] = 'x'
+
+	got, err := db.LoadDocument(d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != d.ID {
+		t.Errorf("Loaded ID %s, expected %s", got.ID, d.ID)
+	}
+	if !bytes.Equal(got.Contents, contents) {
+		t.Errorf("Loaded %q, expected %q", got.Contents, contents)
+	}
+}
+
+// A single-read document must be gone after one load.
+func testBurnOnRead(t *testing.T, db pasteburn.DatabaseService) {
+	d := newBlob(t, "ciphertext")
+	save(t, db, d)
+
+	if _, err := db.LoadDocument(d.ID); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.LoadDocument(d.ID); err != pasteburn.ErrBurned {
+		t.Errorf("Second read returned %v, %v; expected ErrBurned", got, err)
+	}
+}
+
+// A document saved with Reads = n must be readable exactly n times.
+func testReadsCountdown(t *testing.T, db pasteburn.DatabaseService) {
+	d := newBlob(t, "ciphertext")
+	d.Reads = 3
+	save(t, db, d)
+
+	for i := 0; i < 3; i++ {
+		got, err := db.LoadDocument(d.ID)
+		if err != nil {
+			t.Fatalf("Read %d: %v", i+1, err)
+		}
+		if string(got.Contents) != "ciphertext" {
+			t.Errorf("Read %d returned %q", i+1, got.Contents)
+		}
+	}
+	if _, err := db.LoadDocument(d.ID); err != pasteburn.ErrBurned {
+		t.Errorf("Expected ErrBurned after the last read, got %v", err)
+	}
+}
+
+// Records that were never stored, including MultiDocs and copies that don't
+// exist, must be reported as ErrNotFound.
+func testNotFound(t *testing.T, db pasteburn.DatabaseService) {
+	id, _ := uuid.NewV4()
+
+	if _, err := db.LoadDocument(*id); err != pasteburn.ErrNotFound {
+		t.Errorf("Missing document: expected ErrNotFound, got %v", err)
+	}
+	if _, _, err := db.LoadMultiDoc(*id, 0); err != pasteburn.ErrNotFound {
+		t.Errorf("Missing MultiDoc: expected ErrNotFound, got %v", err)
+	}
+	if _, err := db.LoadStream(*id); err != pasteburn.ErrNotFound {
+		t.Errorf("Missing stream: expected ErrNotFound, got %v", err)
+	}
+
+	md, _, err := pasteburn.NewMultiDoc([]byte("secret"), nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveMultiDoc(md); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.LoadMultiDoc(md.ID, 2); err != pasteburn.ErrNotFound {
+		t.Errorf("Missing MultiDoc copy: expected ErrNotFound, got %v", err)
+	}
+}
+
+// Blobs and documents must never be loaded as each other, nor burned by
+// trying to.
+func testBlobsApart(t *testing.T, db pasteburn.DatabaseService) {
+	blob := newBlob(t, "client ciphertext")
+	if err := db.SaveBlob(blob); err != nil {
+		t.Fatal(err)
+	}
+	doc := newBlob(t, "server ciphertext")
+	save(t, db, doc)
+
+	if _, err := db.LoadDocument(blob.ID); err != pasteburn.ErrNotFound {
+		t.Errorf("Loading a blob as a document: expected ErrNotFound, got %v", err)
+	}
+	if _, err := db.LoadBlob(doc.ID); err != pasteburn.ErrNotFound {
+		t.Errorf("Loading a document as a blob: expected ErrNotFound, got %v", err)
+	}
+
+	got, err := db.LoadBlob(blob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Contents) != "client ciphertext" {
+		t.Errorf("Loaded blob %q", got.Contents)
+	}
+	if _, err := db.LoadBlob(blob.ID); err != pasteburn.ErrBurned {
+		t.Errorf("Second blob read: expected ErrBurned, got %v", err)
+	}
+	if _, err := db.LoadDocument(doc.ID); err != nil {
+		t.Errorf("Document was burned by loading it as a blob: %v", err)
+	}
+}
+
+// Reading one copy of a MultiDoc must burn that copy alone.
+func testMultiDocPerIndex(t *testing.T, db pasteburn.DatabaseService) {
+	md, _, err := pasteburn.NewMultiDoc([]byte("secret"), nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md.Reads = 2
+	if err := db.SaveMultiDoc(md); err != nil {
+		t.Fatal(err)
+	}
+
+	// Peeking mustn't use up a read of the copy.
+	peeked, body, err := db.PeekMultiDoc(md.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(peeked.Contents, md.Documents[1].Contents) || !bytes.Equal(body, md.Body) {
+		t.Error("PeekMultiDoc loaded the wrong contents")
+	}
+
+	for _, idx := range []uint32{1, 1} {
+		got, _, err := db.LoadMultiDoc(md.ID, idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Contents, md.Documents[idx].Contents) {
+			t.Errorf("Copy %d loaded the wrong contents", idx)
+		}
+	}
+	if _, _, err := db.LoadMultiDoc(md.ID, 1); err != pasteburn.ErrBurned {
+		t.Errorf("Expected ErrBurned for copy 1, got %v", err)
+	}
+	if _, _, err := db.PeekMultiDoc(md.ID, 1); err != pasteburn.ErrBurned {
+		t.Errorf("Expected ErrBurned peeking at copy 1, got %v", err)
+	}
+
+	for _, idx := range []uint32{0, 2} {
+		if _, _, err := db.LoadMultiDoc(md.ID, idx); err != nil {
+			t.Errorf("Burning copy 1 affected copy %d: %v", idx, err)
+		}
+	}
+}
+
+// Once every copy of a MultiDoc is burned nothing is left for the sweeper,
+// and every copy stays burned.
+func testMultiDocAllBurned(t *testing.T, db pasteburn.DatabaseService) {
+	now := time.Now()
+
+	md, _, err := pasteburn.NewMultiDoc([]byte("secret"), nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md.Expires = now.Add(time.Minute)
+	if err := db.SaveMultiDoc(md); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, idx := range []uint32{0, 1} {
+		if _, _, err := db.LoadMultiDoc(md.ID, idx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := db.PurgeExpired(now.Add(2 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 0 {
+		t.Errorf("Purged %d records after every copy was burned, expected 0", n)
+	}
+
+	for _, idx := range []uint32{0, 1} {
+		if _, _, err := db.LoadMultiDoc(md.ID, idx); err != pasteburn.ErrBurned {
+			t.Errorf("Expected ErrBurned for copy %d, got %v", idx, err)
+		}
+	}
+}
+
+// Copies past the first 256 must be stored apart from the ones whose index
+// shares their low byte, and every copy must load the one shared body.
+func testMultiDocManyCopies(t *testing.T, db pasteburn.DatabaseService) {
+	md, _, err := pasteburn.NewMultiDoc([]byte("secret"), nil, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveMultiDoc(md); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, idx := range []uint32{0, 256, 999} {
+		got, body, err := db.LoadMultiDoc(md.ID, idx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Contents, md.Documents[idx].Contents) {
+			t.Errorf("Copy %d loaded the wrong contents", idx)
+		}
+		if !bytes.Equal(body, md.Body) {
+			t.Errorf("Copy %d loaded the wrong body", idx)
+		}
+	}
+
+	if _, _, err := db.LoadMultiDoc(md.ID, 512); err != nil {
+		t.Errorf("Burning copies 0 and 256 affected copy 512: %v", err)
+	}
+	if _, _, err := db.LoadMultiDoc(md.ID, 1000); err != pasteburn.ErrNotFound {
+		t.Errorf("Missing copy 1000: expected ErrNotFound, got %v", err)
+	}
+}
+
+// A MultiDoc saved with a status token must track reads of each copy until
+// tombstoneTTL after the last one is burned; one without has no status.
+func testMultiDocStatus(t *testing.T, db pasteburn.DatabaseService) {
+	now := time.Now()
+
+	plain, _, err := pasteburn.NewMultiDoc([]byte("secret"), nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveMultiDoc(plain); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.LoadMultiDocStatus(plain.ID); err != pasteburn.ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a MultiDoc without a status, got %v", err)
+	}
+
+	md, _, err := pasteburn.NewMultiDoc([]byte("secret"), nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md.Reads = 2
+	md.Labels = map[uint32]string{0: "alice", 1: "oncall"}
+	if _, err := md.NewStatusToken(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveMultiDoc(md); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := db.LoadMultiDoc(md.ID, 0); err != nil {
+		t.Fatal(err)
+	}
+	st, err := db.LoadMultiDocStatus(md.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(st.Token, md.StatusToken) {
+		t.Error("Status token hash wasn't stored")
+	}
+	alice, oncall := st.Copies[0], st.Copies[1]
+	if alice == nil || oncall == nil {
+		t.Fatalf("Status is missing copies: %+v", st.Copies)
+	}
+	if alice.Reads != 1 || alice.Burned || alice.LastRead.Before(now) {
+		t.Errorf("Status of a read copy is %+v", alice)
+	}
+	if oncall.Reads != 0 || !oncall.LastRead.IsZero() {
+		t.Errorf("Status of an unread copy is %+v", oncall)
+	}
+	// Labels are only readable with the status token, which isn't stored.
+	if len(alice.SealedLabel) == 0 || bytes.Contains(alice.SealedLabel, []byte("alice")) || alice.Label != "" {
+		t.Errorf("Label of a copy was stored as %+v", alice)
+	}
+
+	for _, idx := range []uint32{0, 1, 1} {
+		if _, _, err := db.LoadMultiDoc(md.ID, idx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, err = db.LoadMultiDocStatus(md.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !st.Copies[0].Burned || !st.Copies[1].Burned || st.Finished.IsZero() {
+		t.Errorf("Status after every copy was burned is %+v", st)
+	}
+
+	if _, err := db.PurgeExpired(now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.LoadMultiDocStatus(md.ID); err != nil {
+		t.Errorf("Status was purged early: %v", err)
+	}
+	if _, err := db.PurgeExpired(now.Add(30 * 24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.LoadMultiDocStatus(md.ID); err != pasteburn.ErrNotFound {
+		t.Errorf("Expected ErrNotFound once the status is swept, got %v", err)
+	}
+}
+
+// An expired record must be unreadable even before anything purges it.
+func testExpiredAtLookup(t *testing.T, db pasteburn.DatabaseService) {
+	d := newBlob(t, "ciphertext")
+	d.Expires = time.Now().Add(-time.Second)
+	save(t, db, d)
+
+	for i := 0; i < 2; i++ {
+		if _, err := db.LoadDocument(d.ID); err != pasteburn.ErrExpired {
+			t.Errorf("Read %d: expected ErrExpired, got %v", i+1, err)
+		}
+	}
+
+	md, _, err := pasteburn.NewMultiDoc([]byte("secret"), nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md.Expires = time.Now().Add(-time.Second)
+	if err := db.SaveMultiDoc(md); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := db.LoadMultiDoc(md.ID, 0); err != pasteburn.ErrExpired {
+		t.Errorf("Expected ErrExpired for a MultiDoc copy, got %v", err)
+	}
+	if _, _, err := db.LoadMultiDoc(md.ID, 1); err != pasteburn.ErrExpired {
+		t.Errorf("Expected ErrExpired for the other copy, got %v", err)
+	}
+}
+
+// PurgeExpired must remove and count expired records only, and eventually
+// forget why they're gone.
+func testPurgeExpired(t *testing.T, db pasteburn.DatabaseService) {
+	now := time.Now()
+
+	expired := newBlob(t, "expired")
+	expired.Expires = now.Add(time.Minute)
+	live := newBlob(t, "live")
+	live.Expires = now.Add(time.Hour)
+	save(t, db, expired)
+	save(t, db, live)
+
+	md, _, err := pasteburn.NewMultiDoc([]byte("secret"), nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	md.Expires = now.Add(time.Minute)
+	if err := db.SaveMultiDoc(md); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := db.PurgeExpired(now.Add(2 * time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("Purged %d records, expected 2", n)
+	}
+
+	if _, err := db.LoadDocument(expired.ID); err != pasteburn.ErrExpired {
+		t.Errorf("Expected ErrExpired for a purged document, got %v", err)
+	}
+	if _, _, err := db.LoadMultiDoc(md.ID, 0); err != pasteburn.ErrExpired {
+		t.Errorf("Expected ErrExpired for a purged MultiDoc, got %v", err)
+	}
+
+	got, err := db.LoadDocument(live.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got.Contents) != "live" {
+		t.Error("Unexpired document was purged")
+	}
+
+	if _, err := db.PurgeExpired(now.Add(30 * 24 * time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.LoadDocument(expired.ID); err != pasteburn.ErrNotFound {
+		t.Errorf("Expected ErrNotFound once the tombstone is swept, got %v", err)
+	}
+}
+
+// A stream must read back intact, including through a reader opened by the
+// read that burned it.
+func testStream(t *testing.T, db pasteburn.DatabaseService) {
+	contents := make([]byte, 3<<20+5)
+	for i := range contents {
+		contents[i] = byte(i * 7)
+	}
+
+	id, _ := uuid.NewV4()
+	d := &pasteburn.Document{ID: *id, Reads: 2}
+	if err := db.SaveStream(d, bytes.NewReader(contents)); err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := db.LoadStream(d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := db.LoadStream(d.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.LoadStream(d.ID); err != pasteburn.ErrBurned {
+		t.Errorf("Expected ErrBurned after the last read, got %v", err)
+	}
+
+	for i, r := range []io.ReadCloser{first, last} {
+		got, err := ioutil.ReadAll(r)
+		r.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, contents) {
+			t.Errorf("Reader %d got %d bytes, expected %d", i+1, len(got), len(contents))
+		}
+	}
+}
+
+// race calls load from Racers goroutines at once and returns how many
+// succeeded, failing the test on any error other than ErrBurned.
+func race(t *testing.T, load func() error) int {
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		winners int
+		start   = make(chan struct{})
+	)
+
+	for i := 0; i < Racers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+
+			err := load()
+
+			mtx.Lock()
+			defer mtx.Unlock()
+			switch err {
+			case nil:
+				winners++
+			case pasteburn.ErrBurned:
+			default:
+				t.Errorf("Racing read failed: %v", err)
+			}
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+
+	return winners
+}
+
+// Concurrent loads of the same document must hand out exactly as many reads
+// as it allows.
+func testConcurrentReaders(t *testing.T, db pasteburn.DatabaseService) {
+	for _, reads := range []int{1, 3} {
+		d := newBlob(t, "ciphertext")
+		d.Reads = reads
+		save(t, db, d)
+
+		winners := race(t, func() error {
+			_, err := db.LoadDocument(d.ID)
+			return err
+		})
+		if winners != reads {
+			t.Errorf("%d racing readers got a document allowing %d reads", winners, reads)
+		}
+	}
+}
+
+func testConcurrentMultiDocReaders(t *testing.T, db pasteburn.DatabaseService) {
+	md, _, err := pasteburn.NewMultiDoc([]byte("secret"), nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SaveMultiDoc(md); err != nil {
+		t.Fatal(err)
+	}
+
+	winners := race(t, func() error {
+		_, _, err := db.LoadMultiDoc(md.ID, 0)
+		return err
+	})
+	if winners != 1 {
+		t.Errorf("%d racing readers got the same MultiDoc copy", winners)
+	}
+}
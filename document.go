@@ -1,32 +1,60 @@
 package pasteburn
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
-	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"time"
 
-	log "github.com/Sirupsen/logrus"
 	uuid "github.com/nu7hatch/gouuid"
 )
 
 // A Document contains arbitrary data.
 // Encrypted may be nil if it's not known whether the data is encrypted.
+// Reads is how many times the document may be read before it burns; zero means once.
+// A zero Expires means the document never expires on its own.
+// Metadata is sealed together with Contents and is only meaningful while the
+// document is decrypted.
 type Document struct {
 	ID        uuid.UUID `json:"id"`
 	Contents  []byte    `json:"body"`
+	Metadata  Metadata
 	Encrypted bool
+	Reads     int
+	Expires   time.Time
 }
 
-// A MultiDoc is a set of documents all grouped under a single ID.
+// A MultiDoc is a set of copies of a document all grouped under a single ID.
+// Body is the document encrypted once under a data key, and each copy in
+// Documents holds that key wrapped under its recipient's own key, or a Shamir
+// share of it, see NewShamirMultiDoc. MultiDocs saved before Body existed
+// have none, and their copies carry their own contents.
+// Reads applies to each copy separately, Expires to the whole set.
+// Labels optionally name the recipient of each copy. If StatusToken is set,
+// see NewStatusToken, the set's MultiDocStatus is tracked as copies are read
+// and Labels are kept in it, sealed so only the token's holder can read them.
 type MultiDoc struct {
-	ID        uuid.UUID
-	Documents map[byte]*Document
+	ID          uuid.UUID
+	Body        []byte
+	Documents   map[uint32]*Document
+	Reads       int
+	Expires     time.Time
+	Labels      map[uint32]string
+	StatusToken []byte
+
+	labelKey []byte
 }
 
+// MaxMultiDocCopies bounds how many copies a MultiDoc may be created with.
+const MaxMultiDocCopies = 1 << 16
+
 // AES256KeySizeBytes is the appropriate size for an AES256 encryption key
 // See https://golang.org/pkg/crypto/aes/
 const AES256KeySizeBytes int = 32
@@ -52,62 +80,91 @@ func (d *Document) MarshalJSON() ([]byte, error) {
 
 // Save a Document
 func (d *Document) SaveDoc(db DatabaseService) error {
-
-	if err := db.SaveDocument(d); err != nil {
-		log.WithFields(log.Fields{}).Fatal("Failed to save document")
-		return err
-	}
-
-	return nil
+	return db.SaveDocument(d)
 }
 
 // Save a MultiDoc
 func (md *MultiDoc) SaveMD(db DatabaseService) error {
+	return db.SaveMultiDoc(md)
 
-	if err := db.SaveMultiDoc(md); err != nil {
-		log.WithFields(log.Fields{}).Fatal("Failed to save document")
-		return err
+}
+
+// NewMultiDoc returns a multidoc with count copies of a data body. The body
+// is encrypted once, so each copy only costs a wrapped key. The returned keys
+// are the copy index, 4 bytes big-endian, followed by that copy's key.
+func NewMultiDoc(body []byte, key []byte, count uint32) (*MultiDoc, [][]byte, error) {
+	if count < 1 {
+		// With no copies, nothing could ever read the body to delete it.
+		return nil, nil, errors.New("a multidoc needs at least one copy")
+	}
+	if count > MaxMultiDocCopies {
+		return nil, nil, fmt.Errorf("a multidoc can't have more than %d copies", MaxMultiDocCopies)
 	}
 
-	return nil
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, nil, err
+	}
 
-}
+	dataKey, err := GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
 
-// NewMultiDoc returns a multidoc with N copies of a data body.
-// Only byte copies are allowed for space reasons.
-func NewMultiDoc(body []byte, key []byte, count byte) (*MultiDoc, [][]byte, error) {
-	id, err := uuid.NewV4()
+	// Every copy shares the MultiDoc's ID, which is also what LoadMultiDoc
+	// hands back, so the associated data matches on decryption.
+	d, err := NewDocumentWithID(id, body, dataKey)
 	if err != nil {
 		return nil, nil, err
 	}
 
 	md := &MultiDoc{
 		ID:        *id,
-		Documents: make(map[byte]*Document),
+		Body:      d.Contents,
+		Documents: make(map[uint32]*Document),
 	}
 
 	keys := make([][]byte, count)
 
-	for i := byte(0); i < count; i++ {
+	for i := uint32(0); i < count; i++ {
 		key, err := GenerateKey()
 		if err != nil {
-			return md, nil, err
+			return nil, nil, err
 		}
 
-		// Append the bucket index as an extra byte to the key we return
-		keys[i] = append([]byte{i}, key...)
+		keys[i] = multiDocKey(i, key)
 
-		d, err := NewDocument(body, key)
+		wrapped, err := NewDocumentWithID(id, dataKey, key)
 		if err != nil {
-			return md, nil, err
+			return nil, nil, err
 		}
 
-		md.Documents[i] = d
+		md.Documents[i] = wrapped
 	}
 
 	return md, keys, nil
 }
 
+// multiDocKey is the key handed to the recipient of copy idx.
+func multiDocKey(idx uint32, key []byte) []byte {
+	k := make([]byte, 4, 4+len(key))
+	binary.BigEndian.PutUint32(k, idx)
+	return append(k, key...)
+}
+
+// parseMultiDocKey splits a key from NewMultiDoc into the copy index and the
+// copy's key. Keys from before MultiDocs could have more than 256 copies have
+// a single index byte instead.
+func parseMultiDocKey(key []byte) (uint32, []byte, error) {
+	switch len(key) {
+	case 1 + AES256KeySizeBytes:
+		return uint32(key[0]), key[1:], nil
+	case 4 + AES256KeySizeBytes:
+		return binary.BigEndian.Uint32(key), key[4:], nil
+	}
+	return 0, nil, ErrDecrypt
+}
+
 // NewDocument makes a document with a random ID.
 func NewDocument(body []byte, key []byte) (*Document, error) {
 	id, err := uuid.NewV4()
@@ -117,35 +174,83 @@ func NewDocument(body []byte, key []byte) (*Document, error) {
 	return NewDocumentWithID(id, body, key)
 }
 
-// NewDocumentWithID returns a *Document whose Body is the given body encrypted with the given key.
-func NewDocumentWithID(id *uuid.UUID, body []byte, key []byte) (*Document, error) {
-	if len(key) != AES256KeySizeBytes {
-		err := errors.New("Tried to make a note with AES256 key of the wrong length")
-		log.WithFields(log.Fields{
-			"keyLength": len(key),
-			"keyHash":   sha256.Sum256(key),
-			"key":       string(key),
-		}).Fatal(err)
+// NewBlob makes a document with a random ID from contents that the client has
+// already encrypted. The server can't read them and never tries to.
+func NewBlob(contents []byte) (*Document, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Document{
+		ID:        *id,
+		Contents:  contents,
+		Encrypted: true,
+	}, nil
+}
+
+// NewDocumentWithPassphrase makes a document with a random ID whose body is
+// encrypted under a key stretched from passphrase.
+func NewDocumentWithPassphrase(body []byte, passphrase []byte) (*Document, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Document{
+		ID:       *id,
+		Contents: body,
+	}
+
+	if err := d.EncryptWithPassphrase(passphrase); err != nil {
 		return nil, err
 	}
 
-	// Pad body to a multiple of aes.BlockSize length for encryption.
-	paddingLength := aes.BlockSize - (len(body) % aes.BlockSize)
-	if len(body)%aes.BlockSize == 0 {
-		// Padding must be added because we rely the value of padding bytes
-		// to know how much to chop off after we're done decrypting (RFC 5246 6.2.3.2)
-		paddingLength = aes.BlockSize
+	return d, nil
+}
+
+// NewDocumentFromReader makes a document with a random ID by encrypting
+// everything read from r as a stream under a key stretched from passphrase.
+// The plaintext is encrypted as it's read, but the whole ciphertext is held
+// in memory and stored as one document; large documents belong in PostStream.
+func NewDocumentFromReader(r io.Reader, passphrase []byte) (*Document, error) {
+	return newDocumentFromReader(r, func(w io.Writer, id uuid.UUID) (io.WriteCloser, error) {
+		return NewPassphraseEncryptWriter(w, id, passphrase, nil)
+	})
+}
+
+func newDocumentFromReader(r io.Reader, encrypter func(io.Writer, uuid.UUID) (io.WriteCloser, error)) (*Document, error) {
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
 	}
-	padding := make([]byte, paddingLength)
 
-	// We can afford to cast paddingLength to a byte because we know the AES block size is small.
-	// If it were >127 then we'd end up with nonsense padding data and not know how much to chop off.
-	for i := range padding {
-		padding[i] = byte(paddingLength)
+	var buf bytes.Buffer
+	w, err := encrypter(&buf, *id)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
 	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return &Document{
+		ID:        *id,
+		Contents:  buf.Bytes(),
+		Encrypted: true,
+	}, nil
+}
 
-	body = append(body, padding...)
+// NewDocumentWithID returns a *Document whose Body is the given body encrypted with the given key.
+func NewDocumentWithID(id *uuid.UUID, body []byte, key []byte) (*Document, error) {
+	if len(key) != AES256KeySizeBytes {
+		return nil, ErrKeyLength
+	}
 
+	// GCM encrypts into a new slice, so the caller's body is never modified.
 	d := &Document{
 		ID:       *id,
 		Contents: body,
@@ -159,79 +264,213 @@ func NewDocumentWithID(id *uuid.UUID, body []byte, key []byte) (*Document, error
 }
 
 // EncryptInPlace returns an error if the note could not be encrypted.
-// It encrypts d.Contents using AES256 with the given key.
+// It encrypts d.Metadata and d.Contents using AES256-GCM with the given key and
+// replaces the contents with a serialized Envelope. The document ID and the
+// envelope header are bound as associated data so neither can be swapped out
+// without detection.
 func (d *Document) EncryptInPlace(key []byte) error {
+	return d.seal(key, KDFNone, nil)
+}
 
-	if d.Encrypted {
-		err := errors.New("Tried to encrypt an already-encrypted document.")
-		log.WithFields(log.Fields{
-			"id": d.ID,
-		}).Fatal("Failed encrypting document:", err)
-	}
-
-	if len(d.Contents)%aes.BlockSize != 0 {
-		err := errors.New("Tried to encrypt a plaintext where length % aes.BlockSize != 0")
-		log.WithFields(log.Fields{
-			"id":     d.ID,
-			"body":   d.Contents,
-			"length": len(d.Contents),
-		}).Fatal("Failed encrypting document:", err)
+// EncryptWithPassphrase is like EncryptInPlace, but stretches a passphrase of
+// any length into the AES256 key using DefaultKDFPolicy. The salt and cost
+// parameters are stored in the envelope header.
+func (d *Document) EncryptWithPassphrase(passphrase []byte) error {
+	if len(passphrase) == 0 {
+		return errors.New("Tried to encrypt a document with an empty passphrase")
+	}
+
+	policy := DefaultKDFPolicy
+	params, key, err := policy.newKDFParams(passphrase)
+	if err != nil {
 		return err
 	}
 
-	// Add an extra <blocksize> bytes to prepend IV
-	d.Contents = append(make([]byte, aes.BlockSize), d.Contents...)
+	return d.seal(key, policy.KDF, params)
+}
+
+func (d *Document) seal(key []byte, kdf KDF, kdfParams []byte) error {
 
-	// Fill iv block with random data (iv must be unique but not secure)
-	// (The iv block will not be encrypted)
-	iv := d.Contents[:aes.BlockSize]
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		log.WithFields(log.Fields{
-			"iv": iv,
-		}).Fatal("Failed encrypting document:", err)
+	if d.Encrypted {
+		return errors.New("Tried to encrypt an already-encrypted document.")
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
 		return err
 	}
 
-	cb, err := aes.NewCipher(key)
+	// Nonces must never repeat under the same key; 96 random bits is plenty
+	// for the handful of documents a single key ever encrypts.
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+
+	e := &Envelope{
+		Version:   EnvelopeVersion,
+		Algorithm: AlgAES256GCM,
+		KDF:       kdf,
+		KDFParams: kdfParams,
+		Nonce:     nonce,
+	}
+	plaintext, err := appendMetadata(make([]byte, 0, 4+len(d.Contents)), &d.Metadata)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"key_sha256": sha256.Sum256(key),
-		}).Fatal("Failed encrypting document:", err)
 		return err
 	}
+	plaintext = append(plaintext, d.Contents...)
 
-	mode := cipher.NewCBCEncrypter(cb, iv)
-	mode.CryptBlocks(d.Contents[aes.BlockSize:], d.Contents[aes.BlockSize:])
+	e.Ciphertext = aead.Seal(nil, nonce, plaintext, d.associatedData(e))
 
+	contents, err := e.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	d.Contents = contents
 	d.Encrypted = true
 
 	return nil
 }
 
-// DecryptInPlace returns an error if the note could not be encrypted.
-// It decrypts d.Contents using AES256 with the given key.
+// DecryptInPlace returns an error if the note could not be decrypted.
+// It parses d.Contents as an Envelope and decrypts it with the given key, which
+// is first stretched if the envelope says the document used a passphrase, or
+// is the recipient's private key if it was encrypted with EncryptToRecipient.
+// ErrDecrypt is returned if the key is wrong or the ciphertext was tampered with.
 func (d *Document) DecryptInPlace(key []byte) error {
-	cb, err := aes.NewCipher(key)
+	e, err := ParseEnvelope(d.Contents)
+	if err != nil {
+		return err
+	}
+
+	// Streams derive their own key from the header as they're read.
+	if e.Algorithm == AlgAES256GCMStream {
+		m, r, err := NewDecryptReader(bytes.NewReader(d.Contents), d.ID, key)
+		if err != nil {
+			return err
+		}
+		plaintext, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		d.Metadata = *m
+		d.Contents = plaintext
+		d.Encrypted = false
+		return nil
+	}
+
+	key, err = envelopeKey(e, key)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"key_sha256": sha256.Sum256(key),
-			"key":        string(key),
-		}).Fatal("Failed to create cipher")
 		return err
 	}
 
-	// Cut off leading iv
-	iv := d.Contents[:aes.BlockSize]
-	ciphertext := d.Contents[aes.BlockSize:]
+	var plaintext []byte
+	switch e.Algorithm {
+	case AlgAES256GCM:
+		plaintext, err = d.openGCM(e, key)
+	case AlgAES256CBC:
+		plaintext, err = decryptLegacyCBC(e, key)
+	default:
+		return ErrUnsupportedEnvelope
+	}
+	if err != nil {
+		return err
+	}
 
-	mode := cipher.NewCBCDecrypter(cb, iv)
-	mode.CryptBlocks(ciphertext, ciphertext)
+	m := &Metadata{}
+	if e.Version >= metadataVersion {
+		r := bytes.NewReader(plaintext)
+		if m, err = readMetadata(r); err != nil {
+			return err
+		}
+		plaintext = plaintext[len(plaintext)-r.Len():]
+	}
 
-	// Cut off padding. Go has no way to shrink a slice, so we have to make a new one.
-	paddingLength := int(ciphertext[len(ciphertext)-1])
-	cutBody := make([]byte, len(ciphertext)-paddingLength)
-	copy(cutBody, ciphertext[:len(ciphertext)-paddingLength])
-	d.Contents = cutBody
+	d.Metadata = *m
+	d.Contents = plaintext
+	d.Encrypted = false
 
 	return nil
 }
+
+// envelopeKey returns the AES256 key for an envelope, stretching key first if
+// the envelope was encrypted with a passphrase, or treating it as a private
+// key if it was encrypted to a recipient.
+func envelopeKey(e *Envelope, key []byte) ([]byte, error) {
+	switch e.KDF {
+	case KDFNone, KDFShamir:
+		return key, nil
+	case KDFX25519:
+		return recipientKey(e.KDFParams, key)
+	}
+	return DefaultKDFPolicy.deriveKey(e.KDF, e.KDFParams, key)
+}
+
+// associatedData returns the data authenticated alongside an envelope's ciphertext.
+func (d *Document) associatedData(e *Envelope) []byte {
+	return append(append([]byte{}, d.ID[:]...), e.Header()...)
+}
+
+func (d *Document) openGCM(e *Envelope, key []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	if len(e.Nonce) != aead.NonceSize() {
+		return nil, ErrMalformedEnvelope
+	}
+
+	plaintext, err := aead.Open(nil, e.Nonce, e.Ciphertext, d.associatedData(e))
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return plaintext, nil
+}
+
+// decryptLegacyCBC decrypts documents written before envelopes existed.
+// CBC isn't authenticated, so the padding check is the only way to notice a
+// wrong key and it will occasionally let one through.
+func decryptLegacyCBC(e *Envelope, key []byte) ([]byte, error) {
+	if len(key) != AES256KeySizeBytes {
+		return nil, ErrDecrypt
+	}
+
+	cb, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	plaintext := make([]byte, len(e.Ciphertext))
+	mode := cipher.NewCBCDecrypter(cb, e.Nonce)
+	mode.CryptBlocks(plaintext, e.Ciphertext)
+
+	// Padding bytes all hold the padding length (RFC 5246 6.2.3.2).
+	paddingLength := int(plaintext[len(plaintext)-1])
+	if paddingLength == 0 || paddingLength > aes.BlockSize {
+		return nil, ErrDecrypt
+	}
+	for _, b := range plaintext[len(plaintext)-paddingLength:] {
+		if int(b) != paddingLength {
+			return nil, ErrDecrypt
+		}
+	}
+
+	return plaintext[:len(plaintext)-paddingLength], nil
+}
+
+// newGCM returns an AES256-GCM AEAD for the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != AES256KeySizeBytes {
+		return nil, ErrKeyLength
+	}
+
+	cb, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(cb)
+}
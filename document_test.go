@@ -3,6 +3,8 @@ package pasteburn
 import (
 	"bytes"
 	"testing"
+
+	"golang.org/x/net/context"
 )
 
 func TestEncryptionOnCreate(t *testing.T) {
@@ -55,3 +57,106 @@ func TestDecryptionConsistency(t *testing.T) {
 		t.Error("Document was not properly decrypted")
 	}
 }
+
+// Decrypting with the wrong key must fail authentication instead of
+// returning garbage.
+func TestDecryptionWrongKey(t *testing.T) {
+	plaintext := []byte("secret")
+	key1 := []byte("11112222333344445555666677778888")
+	key2 := []byte("AAAABBBBCCCCDDDDEEEEFFFFGGGGHHHH")
+
+	d, err := NewDocument(plaintext, key1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.DecryptInPlace(key2); err != ErrDecrypt {
+		t.Errorf("Expected ErrDecrypt, got %v", err)
+	}
+}
+
+// Flipping a ciphertext bit or moving the ciphertext to another ID must be detected.
+func TestDecryptionTampered(t *testing.T) {
+	plaintext := []byte("secret")
+	key := []byte("11112222333344445555666677778888")
+
+	d, err := NewDocument(plaintext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := &Document{ID: d.ID, Contents: append([]byte{}, d.Contents...)}
+	tampered.Contents[len(tampered.Contents)-1] ^= 1
+	if err := tampered.DecryptInPlace(key); err != ErrDecrypt {
+		t.Errorf("Expected ErrDecrypt for flipped bit, got %v", err)
+	}
+
+	other, err := NewDocument(plaintext, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := &Document{ID: other.ID, Contents: d.Contents}
+	if err := moved.DecryptInPlace(key); err != ErrDecrypt {
+		t.Errorf("Expected ErrDecrypt for moved ciphertext, got %v", err)
+	}
+
+	truncated := &Document{ID: d.ID, Contents: d.Contents[:6]}
+	if err := truncated.DecryptInPlace(key); err != ErrMalformedEnvelope {
+		t.Errorf("Expected ErrMalformedEnvelope for truncated ciphertext, got %v", err)
+	}
+}
+
+// A MultiDoc's copies must cost the same however large its body is, since
+// they only wrap the key the body is encrypted under.
+func TestMultiDocWrapsDataKey(t *testing.T) {
+	small, _, err := NewMultiDoc([]byte("s"), nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, _, err := NewMultiDoc(make([]byte, 1<<20), nil, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(large.Body) < 1<<20 {
+		t.Errorf("Body is %d bytes, expected the whole document", len(large.Body))
+	}
+	for idx, d := range large.Documents {
+		if len(d.Contents) != len(small.Documents[idx].Contents) {
+			t.Errorf("Copy %d is %d bytes for a large body, %d for a small one",
+				idx, len(d.Contents), len(small.Documents[idx].Contents))
+		}
+	}
+}
+
+// Every copy of a MultiDoc must decrypt to the body, past the old limit of 256
+// copies, and keys with the old single index byte must still work.
+func TestMultiDocManyCopies(t *testing.T) {
+	s := NewDBBackedService(NewMemoryDBService())
+	ctx := context.Background()
+
+	md, keys, err := NewMultiDoc([]byte("secret"), nil, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostMultiDoc(ctx, md); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range [][]byte{keys[299], keys[1][3:]} {
+		d, err := s.GetMultiDoc(ctx, md.ID, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(d.Contents) != "secret" {
+			t.Errorf("Decrypted %q, expected %q", d.Contents, "secret")
+		}
+	}
+
+	if _, err := s.GetMultiDoc(ctx, md.ID, keys[2][:20]); err != ErrDecrypt {
+		t.Errorf("Expected ErrDecrypt for a truncated key, got %v", err)
+	}
+	if _, _, err := NewMultiDoc([]byte("secret"), nil, MaxMultiDocCopies+1); err == nil {
+		t.Error("Expected an error past MaxMultiDocCopies")
+	}
+}
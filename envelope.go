@@ -0,0 +1,183 @@
+package pasteburn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// An Envelope is the self-describing container a Document's ciphertext is stored in.
+//
+// The binary layout is:
+//
+//	magic      4 bytes  "PBRN"
+//	version    1 byte   EnvelopeVersion
+//	algorithm  1 byte   Algorithm
+//	kdf        1 byte   KDF
+//	paramsLen  2 bytes  big endian length of KDFParams
+//	kdfParams  paramsLen bytes
+//	nonceLen   1 byte
+//	nonce      nonceLen bytes
+//	ciphertext remaining bytes
+//
+// Everything before the ciphertext is the header, which AEAD algorithms
+// authenticate as associated data along with the document ID. From version 2
+// on, the plaintext starts with the document's Metadata as described in
+// metadata.go.
+//
+// Documents written before envelopes existed have no header at all; they are
+// parsed as version 0 with the AES256-CBC algorithm and the IV as the nonce.
+type Envelope struct {
+	Version    byte
+	Algorithm  Algorithm
+	KDF        KDF
+	KDFParams  []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// Algorithm identifies the cipher used to produce an Envelope's ciphertext.
+type Algorithm byte
+
+// KDF identifies how the encryption key is derived from the key supplied by the user.
+type KDF byte
+
+const (
+	// AlgAES256CBC is the legacy unauthenticated mode. It is only ever read, never written.
+	AlgAES256CBC Algorithm = 0
+	// AlgAES256GCM is AES256 in Galois/Counter Mode.
+	AlgAES256GCM Algorithm = 1
+	// AlgAES256GCMStream is AES256-GCM applied to 64 KiB segments as described in stream.go.
+	AlgAES256GCMStream Algorithm = 2
+)
+
+const (
+	// KDFNone means the supplied key is used directly as the AES256 key.
+	KDFNone KDF = 0
+)
+
+// EnvelopeVersion is the envelope format version written by this package.
+const EnvelopeVersion byte = 2
+
+var envelopeMagic = []byte("PBRN")
+
+var (
+	// ErrMalformedEnvelope is returned when stored bytes can't be parsed as an envelope.
+	ErrMalformedEnvelope = errors.New("malformed document envelope")
+	// ErrUnsupportedEnvelope is returned for envelope versions or algorithms this build can't read.
+	ErrUnsupportedEnvelope = errors.New("unsupported document envelope")
+)
+
+// Header returns the serialized envelope header, which is everything but the ciphertext.
+func (e *Envelope) Header() []byte {
+	var b bytes.Buffer
+	b.Write(envelopeMagic)
+	b.WriteByte(e.Version)
+	b.WriteByte(byte(e.Algorithm))
+	b.WriteByte(byte(e.KDF))
+	binary.Write(&b, binary.BigEndian, uint16(len(e.KDFParams)))
+	b.Write(e.KDFParams)
+	b.WriteByte(byte(len(e.Nonce)))
+	b.Write(e.Nonce)
+	return b.Bytes()
+}
+
+// MarshalBinary returns the envelope in its stored form.
+func (e *Envelope) MarshalBinary() ([]byte, error) {
+	if e.Version == 0 {
+		return nil, errors.New("legacy envelopes can't be written")
+	}
+	if len(e.KDFParams) > 0xffff || len(e.Nonce) > 0xff {
+		return nil, ErrMalformedEnvelope
+	}
+	return append(e.Header(), e.Ciphertext...), nil
+}
+
+// ParseEnvelope parses stored document bytes.
+// Bytes without the envelope magic are treated as the legacy IV||ciphertext CBC layout.
+func ParseEnvelope(b []byte) (*Envelope, error) {
+	if !bytes.HasPrefix(b, envelopeMagic) {
+		return parseLegacyEnvelope(b)
+	}
+
+	r := b[len(envelopeMagic):]
+	if len(r) < 5 {
+		return nil, ErrMalformedEnvelope
+	}
+
+	e := &Envelope{
+		Version:   r[0],
+		Algorithm: Algorithm(r[1]),
+		KDF:       KDF(r[2]),
+	}
+	if e.Version == 0 || e.Version > EnvelopeVersion {
+		return nil, ErrUnsupportedEnvelope
+	}
+
+	paramsLen := int(binary.BigEndian.Uint16(r[3:5]))
+	r = r[5:]
+	if len(r) < paramsLen+1 {
+		return nil, ErrMalformedEnvelope
+	}
+	e.KDFParams = r[:paramsLen]
+	r = r[paramsLen:]
+
+	nonceLen := int(r[0])
+	r = r[1:]
+	if len(r) < nonceLen {
+		return nil, ErrMalformedEnvelope
+	}
+	e.Nonce = r[:nonceLen]
+	e.Ciphertext = r[nonceLen:]
+
+	return e, nil
+}
+
+// ReadEnvelopeHeader reads just the header of an envelope from r, leaving r
+// positioned at the start of the ciphertext. Legacy envelopes have no header
+// and can't be read this way.
+func ReadEnvelopeHeader(r io.Reader) (*Envelope, error) {
+	fixed := make([]byte, len(envelopeMagic)+5)
+	if _, err := io.ReadFull(r, fixed); err != nil {
+		return nil, ErrMalformedEnvelope
+	}
+	if !bytes.HasPrefix(fixed, envelopeMagic) {
+		return nil, ErrMalformedEnvelope
+	}
+
+	paramsLen := int(binary.BigEndian.Uint16(fixed[len(fixed)-2:]))
+	rest := make([]byte, paramsLen+1)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, ErrMalformedEnvelope
+	}
+
+	nonce := make([]byte, rest[paramsLen])
+	if _, err := io.ReadFull(r, nonce); err != nil {
+		return nil, ErrMalformedEnvelope
+	}
+
+	e, err := ParseEnvelope(append(append(fixed, rest...), nonce...))
+	if err != nil {
+		return nil, err
+	}
+	e.Ciphertext = nil
+
+	return e, nil
+}
+
+// parseLegacyEnvelope reads the pre-envelope layout, which was a 16 byte IV
+// followed by whole AES blocks of CBC ciphertext.
+func parseLegacyEnvelope(b []byte) (*Envelope, error) {
+	const blockSize = 16
+	if len(b) < 2*blockSize || len(b)%blockSize != 0 {
+		return nil, ErrMalformedEnvelope
+	}
+	return &Envelope{
+		Version:    0,
+		Algorithm:  AlgAES256CBC,
+		KDF:        KDFNone,
+		Nonce:      b[:blockSize],
+		Ciphertext: b[blockSize:],
+	}, nil
+}
@@ -0,0 +1,98 @@
+package pasteburn
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+// An encrypted document should parse back into the same envelope fields it was written with.
+func TestEnvelopeRoundTrip(t *testing.T) {
+	key := []byte("11112222333344445555666677778888")
+	d, err := NewDocument([]byte("secret"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := ParseEnvelope(d.Contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e.Version != EnvelopeVersion || e.Algorithm != AlgAES256GCM || e.KDF != KDFNone {
+		t.Errorf("Unexpected envelope header %+v", e)
+	}
+
+	b, err := e.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, d.Contents) {
+		t.Error("Re-marshalled envelope differs from stored bytes")
+	}
+}
+
+// Changing the header must break authentication even though the ciphertext is untouched.
+func TestEnvelopeHeaderAuthenticated(t *testing.T) {
+	key := []byte("11112222333344445555666677778888")
+	d, err := NewDocument([]byte("secret"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e, err := ParseEnvelope(d.Contents)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.KDFParams = []byte{1}
+	d.Contents, _ = e.MarshalBinary()
+
+	if err := d.DecryptInPlace(key); err != ErrUnsupportedEnvelope && err != ErrDecrypt {
+		t.Errorf("Expected tampered header to be rejected, got %v", err)
+	}
+}
+
+// Documents stored as IV||CBC ciphertext before envelopes existed must stay readable.
+func TestEnvelopeLegacyCBC(t *testing.T) {
+	key := []byte("11112222333344445555666677778888")
+	plaintext := []byte("secret")
+
+	padded := append([]byte{}, plaintext...)
+	for i := 0; i < aes.BlockSize-len(plaintext); i++ {
+		padded = append(padded, byte(aes.BlockSize-len(plaintext)))
+	}
+
+	cb, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := make([]byte, aes.BlockSize+len(padded))
+	copy(stored, "0123456789abcdef")
+	cipher.NewCBCEncrypter(cb, stored[:aes.BlockSize]).CryptBlocks(stored[aes.BlockSize:], padded)
+
+	d := &Document{Contents: stored}
+	if err := d.DecryptInPlace(key); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(d.Contents, plaintext) {
+		t.Errorf("Legacy document decrypted to %q", d.Contents)
+	}
+}
+
+func TestEnvelopeMalformed(t *testing.T) {
+	for _, b := range [][]byte{
+		nil,
+		[]byte("PBRN"),
+		[]byte("PBRN\x01\x01\x00\xff\xff"),
+		[]byte("PBRN\x01\x01\x00\x00\x00\x0c\x00"),
+		[]byte("short legacy"),
+	} {
+		if _, err := ParseEnvelope(b); err != ErrMalformedEnvelope {
+			t.Errorf("ParseEnvelope(%q) = %v, expected ErrMalformedEnvelope", b, err)
+		}
+	}
+
+	if _, err := ParseEnvelope([]byte("PBRN\x09\x01\x00\x00\x00\x00")); err != ErrUnsupportedEnvelope {
+		t.Errorf("Expected ErrUnsupportedEnvelope for unknown version, got %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+package pasteburn
+
+import (
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrNotFound is returned when no document was ever stored under an ID.
+	ErrNotFound = errors.New("document not found")
+	// ErrBurned is returned when a document has already been read as many times as allowed.
+	ErrBurned = errors.New("document has already been read")
+	// ErrExpired is returned when a document's TTL ran out before it was read.
+	ErrExpired = errors.New("document has expired")
+	// ErrDecrypt is returned when a document fails authentication, which means
+	// either the key is wrong or the stored ciphertext has been corrupted.
+	ErrDecrypt = errors.New("authentication failed: wrong key or corrupted document")
+	// ErrKeyLength is returned when a raw key isn't an AES256 key.
+	ErrKeyLength = errors.New("key must be 32 bytes")
+	// ErrMissingKey is returned when a view request has no key, which is
+	// refused before anything is loaded so the document isn't burned.
+	ErrMissingKey = errors.New("a key is required to view a document")
+)
+
+// httpStatus maps errors from the Service to HTTP status codes.
+func httpStatus(err error) int {
+	switch err {
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrBurned, ErrExpired:
+		return http.StatusGone
+	case ErrDecrypt:
+		return http.StatusForbidden
+	case ErrKeyLength, ErrMissingKey, ErrFileSize, ErrShareKey, ErrNotEnoughShares:
+		return http.StatusBadRequest
+	case ErrMalformedEnvelope, ErrUnsupportedEnvelope, ErrKDFLimits:
+		// The document can't be decrypted as stored, which no retry fixes.
+		// It isn't gone, though, so this mustn't look like ErrBurned.
+		return http.StatusUnprocessableEntity
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeError responds to a failed request with the status code for err.
+func writeError(w http.ResponseWriter, err error) {
+	http.Error(w, err.Error(), httpStatus(err))
+}
@@ -0,0 +1,114 @@
+package pasteburn
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestViewStatusCodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pasteburn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBoltBackedService(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	view := MakeTextViewHandler(ctx, s)
+	key := []byte("11112222333344445555666677778888")
+
+	get := func(id string, k []byte) int {
+		rec := httptest.NewRecorder()
+		view(rec, httptest.NewRequest("GET", "/api/text/view?id="+id+"&k="+EncodeShareKey(k), nil))
+		return rec.Code
+	}
+
+	missing, err := NewDocument([]byte("secret"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := get(missing.ID.String(), key); code != http.StatusNotFound {
+		t.Errorf("Missing document returned %d", code)
+	}
+
+	wrongKey, err := NewDocument([]byte("secret"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostDocument(ctx, wrongKey); err != nil {
+		t.Fatal(err)
+	}
+	if code := get(wrongKey.ID.String(), []byte("AAAABBBBCCCCDDDDEEEEFFFFGGGGHHHH")); code != http.StatusForbidden {
+		t.Errorf("Wrong key returned %d", code)
+	}
+
+	burned, err := NewDocument([]byte("secret"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostDocument(ctx, burned); err != nil {
+		t.Fatal(err)
+	}
+	if code := get(burned.ID.String(), key); code != http.StatusOK {
+		t.Errorf("First read returned %d", code)
+	}
+	if code := get(burned.ID.String(), key); code != http.StatusGone {
+		t.Errorf("Second read returned %d", code)
+	}
+
+	costly := &Envelope{
+		Version:   EnvelopeVersion,
+		Algorithm: AlgAES256GCM,
+		KDF:       KDFArgon2id,
+		KDFParams: append([]byte{0, 0, 0, 100, 0, 0, 1, 0, 1, 16}, make([]byte, 16)...),
+		Nonce:     make([]byte, 12),
+	}
+	costlyContents, err := costly.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		contents []byte
+		code     int
+	}{
+		{"Malformed envelope", []byte("PBRN\x02"), http.StatusUnprocessableEntity},
+		{"KDF over the limits", costlyContents, http.StatusUnprocessableEntity},
+		{"Unsupported envelope", []byte("PBRN\xff\x01\x00\x00\x00\x00"), http.StatusUnprocessableEntity},
+	} {
+		d, err := NewBlob(tc.contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PostDocument(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+		if code := get(d.ID.String(), key); code != tc.code {
+			t.Errorf("%s returned %d, expected %d", tc.name, code, tc.code)
+		}
+	}
+}
+
+// Bad input must come back as an error instead of taking the process down.
+func TestBadKeyReturnsError(t *testing.T) {
+	if _, err := NewDocument([]byte("secret"), []byte("short")); err != ErrKeyLength {
+		t.Errorf("Expected ErrKeyLength, got %v", err)
+	}
+
+	d := &Document{Contents: []byte("not an envelope")}
+	if err := d.DecryptInPlace([]byte("short")); err == nil {
+		t.Error("Expected an error decrypting garbage")
+	}
+}
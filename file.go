@@ -0,0 +1,61 @@
+package pasteburn
+
+import (
+	"errors"
+	"io"
+	"strings"
+
+	uuid "github.com/nu7hatch/gouuid"
+	"golang.org/x/net/context"
+)
+
+// ErrFileSize is returned when an uploaded file isn't as long as declared.
+var ErrFileSize = errors.New("file length doesn't match its declared size")
+
+// DefaultFileType is served for files uploaded without a usable MIME type.
+const DefaultFileType = "application/octet-stream"
+
+// cleanFileName strips any directories from a client-supplied file name.
+func cleanFileName(name string) string {
+	return name[strings.LastIndexAny(name, `/\`)+1:]
+}
+
+// PostFile encrypts exactly d.Metadata.Size bytes read from r as they arrive
+// and stores them under d.ID with s.PostStream. encrypter is NewEncryptWriter
+// or NewPassphraseEncryptWriter with the key and d.Metadata bound.
+// It returns ErrFileSize if r ends early.
+func PostFile(ctx context.Context, s Service, d *Document, r io.Reader, encrypter func(io.Writer, uuid.UUID) (io.WriteCloser, error)) error {
+	pr, pw := io.Pipe()
+
+	go func() {
+		pw.CloseWithError(encryptFile(pw, d.ID, d.Metadata.Size, r, encrypter))
+	}()
+
+	err := s.PostStream(ctx, d, pr)
+	// Unblocks the encrypting goroutine if the store gave up early.
+	pr.CloseWithError(errors.New("file upload aborted"))
+
+	return err
+}
+
+func encryptFile(w io.Writer, id uuid.UUID, size int64, r io.Reader, encrypter func(io.Writer, uuid.UUID) (io.WriteCloser, error)) error {
+	ew, err := encrypter(w, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(ew, io.LimitReader(r, size))
+	if err == io.ErrUnexpectedEOF {
+		// What an HTTP request body ends with when it's shorter than its
+		// Content-Length; the client sent too little, like any short read.
+		return ErrFileSize
+	}
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return ErrFileSize
+	}
+
+	return ew.Close()
+}
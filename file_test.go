@@ -0,0 +1,247 @@
+package pasteburn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/iotest"
+
+	log "github.com/Sirupsen/logrus"
+	uuid "github.com/nu7hatch/gouuid"
+	"golang.org/x/net/context"
+)
+
+// A file must be served once with the name, type and length it was uploaded with.
+func TestFileCreateView(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pasteburn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBoltBackedService(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	contents := make([]byte, 2*StreamSegmentSize+9)
+	rand.Read(contents)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/file/create?generateKey=true", bytes.NewReader(contents))
+	req.Header.Set("Content-Type", "application/pdf")
+	req.Header.Set("Content-Disposition", `attachment; filename="../report.pdf"`)
+	MakeFileAddHandler(ctx, s)(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Create returned status %d: %s", rec.Code, rec.Body)
+	}
+
+	var res struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	MakeFileViewHandler(ctx, s)(rec, httptest.NewRequest("GET", res.URL, nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("View returned status %d: %s", rec.Code, rec.Body)
+	}
+	for name, want := range map[string]string{
+		"Content-Type":        "application/pdf",
+		"Content-Length":      "131081",
+		"Content-Disposition": `attachment; filename=report.pdf`,
+	} {
+		if got := rec.Header().Get(name); got != want {
+			t.Errorf("%s is %q, expected %q", name, got, want)
+		}
+	}
+	if !bytes.Equal(rec.Body.Bytes(), contents) {
+		t.Error("Served file doesn't match the upload")
+	}
+
+	rec = httptest.NewRecorder()
+	MakeFileViewHandler(ctx, s)(rec, httptest.NewRequest("GET", res.URL, nil))
+	if rec.Code != http.StatusGone {
+		t.Errorf("Second view returned status %d, expected %d", rec.Code, http.StatusGone)
+	}
+}
+
+// An upload shorter than its declared size must fail and leave nothing readable.
+func TestFileShortUpload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pasteburn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBoltBackedService(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	key := []byte("11112222333344445555666677778888")
+	id, _ := uuid.NewV4()
+	d := &Document{ID: *id, Metadata: Metadata{Size: 100}, Encrypted: true}
+
+	err = PostFile(ctx, s, d, bytes.NewReader(make([]byte, 99)), func(w io.Writer, id uuid.UUID) (io.WriteCloser, error) {
+		return NewEncryptWriter(w, id, key, &d.Metadata)
+	})
+	if err != ErrFileSize {
+		t.Fatalf("Expected ErrFileSize, got %v", err)
+	}
+
+	if _, _, err := s.GetStream(ctx, d.ID, key); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for a failed upload, got %v", err)
+	}
+}
+
+// A request body that ends before its Content-Length is the client's fault,
+// not the server's.
+func TestFileTruncatedBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pasteburn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBoltBackedService(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	// net/http's body reader returns io.ErrUnexpectedEOF when the
+	// connection closes early.
+	body := io.MultiReader(bytes.NewReader(make([]byte, 99)), iotest.ErrReader(io.ErrUnexpectedEOF))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/file/create?key=hunter2", body)
+	req.ContentLength = 100
+	MakeFileAddHandler(ctx, s)(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("Expected status 400, got %d: %s", rec.Code, rec.Body)
+	}
+}
+
+// A segment failing authentication partway through a file must abort the
+// response instead of ending it cleanly with what was sent so far.
+func TestFileViewAbortsOnCorruptSegment(t *testing.T) {
+	db := NewMemoryDBService()
+	s := NewDBBackedService(db)
+	ctx := context.Background()
+
+	var out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	s.Logger = logger
+
+	contents := make([]byte, 2*StreamSegmentSize)
+	rec := httptest.NewRecorder()
+	MakeFileAddHandler(ctx, s)(rec, httptest.NewRequest("POST", "/api/file/create?key=hunter2", bytes.NewReader(contents)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Create returned status %d: %s", rec.Code, rec.Body)
+	}
+	var res struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	id, err := uuid.ParseHex(res.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := db.streams[string(id[:])].contents
+	stored[len(stored)-1] ^= 1
+
+	defer func() {
+		if r := recover(); r != http.ErrAbortHandler {
+			t.Errorf("Expected the handler to abort, recovered %v", r)
+		}
+		// The failure must go through the service's logger, not the global one.
+		if !bytes.Contains(out.Bytes(), []byte("Failed partway through a stream")) {
+			t.Errorf("The failure wasn't logged through the service's logger: %q", out.String())
+		}
+	}()
+	MakeFileViewHandler(ctx, s)(httptest.NewRecorder(), httptest.NewRequest("GET", "/api/file/view?id="+res.ID+"&key=hunter2", nil))
+}
+
+// Images must be stored as streams and served with the type sniffed on
+// upload, while images stored as documents before that still work.
+func TestImageCreateView(t *testing.T) {
+	db := NewMemoryDBService()
+	s := NewDBBackedService(db)
+	ctx := context.Background()
+
+	image := append([]byte("\x89PNG\r\n\x1a\n"), make([]byte, StreamSegmentSize+9)...)
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("generateKey", "true")
+	fw, err := mw.CreateFormFile("image", "cat.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(image)
+	mw.Close()
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/image/create", &form)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	MakeImageAddHandler(ctx, s)(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Create returned status %d: %s", rec.Code, rec.Body)
+	}
+	if len(db.streams) != 1 || len(db.documents) != 0 {
+		t.Errorf("Image was stored as %d streams and %d documents", len(db.streams), len(db.documents))
+	}
+
+	var res struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	MakeImageViewHandler(ctx, s)(rec, httptest.NewRequest("GET", res.URL, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("View returned status %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type is %q", got)
+	}
+	if !bytes.Equal(rec.Body.Bytes(), image) {
+		t.Error("Served image doesn't match the upload")
+	}
+
+	legacy, err := NewDocumentFromReader(bytes.NewReader(image), []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostDocument(ctx, legacy); err != nil {
+		t.Fatal(err)
+	}
+	rec = httptest.NewRecorder()
+	MakeImageViewHandler(ctx, s)(rec, httptest.NewRequest("GET", "/api/image/view?id="+legacy.ID.String()+"&key=hunter2", nil))
+	if rec.Code != http.StatusOK || !bytes.Equal(rec.Body.Bytes(), image) {
+		t.Errorf("Legacy image view returned status %d", rec.Code)
+	}
+}
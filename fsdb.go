@@ -0,0 +1,720 @@
+package pasteburn
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// FileDBService implements DatabaseService with plain files under a directory:
+//
+//	documents/<key>        document or blob contents, under its ID or blobKey
+//	streams/<id>           stream contents
+//	multidocs/<id>/<idx>   contents of each MultiDoc copy
+//	multidocs/<id>/shared  the body its copies' keys decrypt, if it has one
+//	state/<key>            read count and deadline, if the record has either
+//	tombstones/<key>       why a record is gone, as in BoltDBService
+//	statuses/<id>/status   a MultiDoc's status, if it has one
+//	statuses/<id>/<idx>    the status of each of its copies
+//	tmp/                   staging area; everything is renamed into place
+//	lock                   locked by the FileDBService using the directory
+//
+// Names are the hex encoding of the same keys BoltDBService uses. A record
+// exists exactly when its contents file does, so removing that file is what
+// burns it. Only one FileDBService may use a directory at a time, which the
+// lock file enforces across processes, and since burned streams are unlinked
+// while readers still have them open, the directory must be on a filesystem
+// with POSIX semantics.
+type FileDBService struct {
+	dir  string
+	lock *os.File
+	mtx  sync.Mutex
+}
+
+var fsDirs = []string{"documents", "streams", "multidocs", "state", "tombstones", "statuses", "tmp"}
+
+// ErrDirLocked is returned by NewFileDBService when another FileDBService,
+// in this process or another, is already using the directory.
+var ErrDirLocked = errors.New("directory is in use by another FileDBService")
+
+// NewFileDBService returns a FileDBService storing everything under dir,
+// which is created if needed. It takes an exclusive lock on the directory
+// for as long as it's open, as Bolt does on its file, and fails with
+// ErrDirLocked rather than waiting if it can't.
+func NewFileDBService(dir string) (*FileDBService, error) {
+	for _, d := range fsDirs {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0700); err != nil {
+			return nil, err
+		}
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, "lock"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		return nil, err
+	}
+
+	return &FileDBService{dir: dir, lock: lock}, nil
+}
+
+// Close releases the lock on the directory.
+func (s *FileDBService) Close() error {
+	return s.lock.Close()
+}
+
+// SaveDocument saves a document.
+func (s *FileDBService) SaveDocument(d *Document) error {
+	return s.saveDocument(d, hex.EncodeToString(d.ID[:]))
+}
+
+// SaveBlob saves a blob.
+func (s *FileDBService) SaveBlob(d *Document) error {
+	return s.saveDocument(d, hex.EncodeToString(blobKey(d.ID)))
+}
+
+func (s *FileDBService) saveDocument(d *Document, key string) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if err := s.writeState(key, d.Reads, d.Expires); err != nil {
+		return err
+	}
+	return s.writeFile(s.path("documents", key), d.Contents)
+}
+
+// LoadDocument consumes one read of the document stored under id.
+func (s *FileDBService) LoadDocument(id uuid.UUID) (*Document, error) {
+	return s.loadDocument(id, hex.EncodeToString(id[:]))
+}
+
+// LoadBlob consumes one read of the blob stored under id.
+func (s *FileDBService) LoadBlob(id uuid.UUID) (*Document, error) {
+	return s.loadDocument(id, hex.EncodeToString(blobKey(id)))
+}
+
+func (s *FileDBService) loadDocument(id uuid.UUID, key string) (*Document, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	path := s.path("documents", key)
+
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, s.tombstoneErr(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.consume(path, key, time.Now()); err != nil {
+		return nil, err
+	}
+
+	return &Document{
+		ID:       id,
+		Contents: contents,
+	}, nil
+}
+
+// SaveMultiDoc saves a MultiDoc. Its copies are staged in a directory that's
+// renamed into place, so a partly saved MultiDoc is never visible.
+func (s *FileDBService) SaveMultiDoc(md *MultiDoc) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	staging, err := ioutil.TempDir(s.path("tmp"), "multidoc")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	if md.Body != nil {
+		if err := ioutil.WriteFile(filepath.Join(staging, multiDocBodyName), md.Body, 0600); err != nil {
+			return err
+		}
+	}
+	for idx, d := range md.Documents {
+		if err := s.writeState(hex.EncodeToString(multiDocReadsKey(md.ID, idx)), md.Reads, time.Time{}); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(staging, hex.EncodeToString(multiDocIndex(idx))), d.Contents, 0600); err != nil {
+			return err
+		}
+	}
+
+	key := hex.EncodeToString(md.ID[:])
+	if err := s.writeState(key, 0, md.Expires); err != nil {
+		return err
+	}
+	st, err := newMultiDocStatus(md)
+	if err != nil {
+		return err
+	}
+	if st != nil {
+		if err := s.saveStatus(key, st); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(staging, s.path("multidocs", key))
+}
+
+// saveStatus stores a new MultiDoc status, staged like the MultiDoc itself.
+func (s *FileDBService) saveStatus(key string, st *MultiDocStatus) error {
+	staging, err := ioutil.TempDir(s.path("tmp"), "status")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	v, err := st.marshal()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(staging, fsStatusName), v, 0600); err != nil {
+		return err
+	}
+	for idx, c := range st.Copies {
+		v, err := c.marshal()
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(staging, hex.EncodeToString(multiDocIndex(idx))), v, 0600); err != nil {
+			return err
+		}
+	}
+
+	return os.Rename(staging, s.path("statuses", key))
+}
+
+// LoadMultiDoc consumes one read of the copy at idx of the MultiDoc stored under id.
+func (s *FileDBService) LoadMultiDoc(id uuid.UUID, idx uint32) (*Document, []byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := time.Now()
+	key := hex.EncodeToString(id[:])
+	copyKey := hex.EncodeToString(multiDocReadsKey(id, idx))
+
+	if _, err := os.Stat(s.path("multidocs", key)); os.IsNotExist(err) {
+		return nil, nil, s.tombstoneErr(copyKey, key)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	st, err := s.readState(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if expiredAt(st.expires, now) {
+		if err := s.deleteMultiDoc(key, now); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrExpired
+	}
+
+	body, err := ioutil.ReadFile(s.path("multidocs", key, multiDocBodyName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	path := s.path("multidocs", key, hex.EncodeToString(multiDocIndex(idx)))
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil, s.tombstoneErr(copyKey)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := s.consume(path, copyKey, now); err != nil {
+		return nil, nil, err
+	}
+	_, err = os.Stat(path)
+	burned := os.IsNotExist(err)
+	if err := s.recordRead(key, idx, burned, now); err != nil {
+		return nil, nil, err
+	}
+	if err := s.removeEmptyMultiDoc(key, now); err != nil {
+		return nil, nil, err
+	}
+
+	return &Document{
+		ID:       id,
+		Contents: contents,
+	}, body, nil
+}
+
+// PeekMultiDoc returns the copy at idx of the MultiDoc stored under id and
+// its Body without consuming a read.
+func (s *FileDBService) PeekMultiDoc(id uuid.UUID, idx uint32) (*Document, []byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	key := hex.EncodeToString(id[:])
+	copyKey := hex.EncodeToString(multiDocReadsKey(id, idx))
+
+	if _, err := os.Stat(s.path("multidocs", key)); os.IsNotExist(err) {
+		return nil, nil, s.tombstoneErr(copyKey, key)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	st, err := s.readState(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if expiredAt(st.expires, time.Now()) {
+		return nil, nil, ErrExpired
+	}
+
+	contents, err := ioutil.ReadFile(s.path("multidocs", key, hex.EncodeToString(multiDocIndex(idx))))
+	if os.IsNotExist(err) {
+		return nil, nil, s.tombstoneErr(copyKey)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	body, err := ioutil.ReadFile(s.path("multidocs", key, multiDocBodyName))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	return &Document{
+		ID:       id,
+		Contents: contents,
+	}, body, nil
+}
+
+// SaveStream saves everything read from r, staging it in a temporary file so
+// the stream only appears once it's complete.
+func (s *FileDBService) SaveStream(d *Document, r io.Reader) error {
+	f, err := ioutil.TempFile(s.path("tmp"), "stream")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	key := hex.EncodeToString(d.ID[:])
+	if err := s.writeState(key, d.Reads, d.Expires); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path("streams", key))
+}
+
+// LoadStream consumes one read of the stream stored under id. The returned
+// reader keeps working even if that was the last read.
+func (s *FileDBService) LoadStream(id uuid.UUID) (io.ReadCloser, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	key := hex.EncodeToString(id[:])
+	path := s.path("streams", key)
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, s.tombstoneErr(key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.consume(path, key, time.Now()); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// PurgeExpired deletes every record whose deadline is at or before now,
+// drops tombstones and MultiDoc statuses once they've outlived tombstoneTTL
+// and removes staging files left by saves that never finished. Unlike Bolt
+// there's no index, so it reads every state file, tombstone and status.
+func (s *FileDBService) PurgeExpired(now time.Time) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	states, err := ioutil.ReadDir(s.path("state"))
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, fi := range states {
+		key := fi.Name()
+		st, err := s.readState(key)
+		if err != nil {
+			return purged, err
+		}
+		if !expiredAt(st.expires, now) {
+			continue
+		}
+
+		for _, kind := range []string{"documents", "streams"} {
+			path := s.path(kind, key)
+			if _, err := os.Stat(path); err == nil {
+				if err := s.deleteRecord(path, key, tombstoneExpired, now); err != nil {
+					return purged, err
+				}
+				purged++
+			}
+		}
+		if _, err := os.Stat(s.path("multidocs", key)); err == nil {
+			if err := s.deleteMultiDoc(key, now); err != nil {
+				return purged, err
+			}
+			purged++
+		}
+	}
+
+	tombstones, err := ioutil.ReadDir(s.path("tombstones"))
+	if err != nil {
+		return purged, err
+	}
+	for _, fi := range tombstones {
+		v, err := ioutil.ReadFile(s.path("tombstones", fi.Name()))
+		if err != nil || len(v) != 9 {
+			continue
+		}
+		if !time.Unix(0, int64(binary.BigEndian.Uint64(v[1:]))).Add(tombstoneTTL).After(now) {
+			os.Remove(s.path("tombstones", fi.Name()))
+		}
+	}
+
+	statuses, err := ioutil.ReadDir(s.path("statuses"))
+	if err != nil {
+		return purged, err
+	}
+	for _, fi := range statuses {
+		v, err := ioutil.ReadFile(s.path("statuses", fi.Name(), fsStatusName))
+		if err != nil {
+			continue
+		}
+		if st, err := parseMultiDocStatus(v); err == nil && st.stale(now) {
+			os.RemoveAll(s.path("statuses", fi.Name()))
+		}
+	}
+
+	staged, err := ioutil.ReadDir(s.path("tmp"))
+	if err != nil {
+		return purged, err
+	}
+	for _, fi := range staged {
+		if now.Sub(fi.ModTime()) > orphanTTL {
+			os.RemoveAll(s.path("tmp", fi.Name()))
+		}
+	}
+
+	return purged, nil
+}
+
+// fsState is what's kept in a state file.
+type fsState struct {
+	reads   int
+	expires time.Time
+}
+
+func (s *FileDBService) path(elem ...string) string {
+	return filepath.Join(append([]string{s.dir}, elem...)...)
+}
+
+// writeFile replaces path with data atomically.
+func (s *FileDBService) writeFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(s.path("tmp"), "write")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// readState returns the state of key. Records without a state file get one
+// read and never expire.
+func (s *FileDBService) readState(key string) (fsState, error) {
+	v, err := ioutil.ReadFile(s.path("state", key))
+	if os.IsNotExist(err) {
+		return fsState{reads: 1}, nil
+	}
+	if err != nil {
+		return fsState{}, err
+	}
+	if len(v) != 12 {
+		return fsState{}, errors.New("malformed state file")
+	}
+
+	st := fsState{reads: int(binary.BigEndian.Uint32(v))}
+	if ns := int64(binary.BigEndian.Uint64(v[4:])); ns != 0 {
+		st.expires = time.Unix(0, ns)
+	}
+	return st, nil
+}
+
+// writeState records the state of key, removing the state file if there's
+// nothing worth recording.
+func (s *FileDBService) writeState(key string, reads int, expires time.Time) error {
+	if reads <= 1 && expires.IsZero() {
+		return s.removeState(key)
+	}
+
+	v := make([]byte, 12)
+	binary.BigEndian.PutUint32(v, uint32(maxInt(reads, 1)))
+	if !expires.IsZero() {
+		binary.BigEndian.PutUint64(v[4:], uint64(expires.UnixNano()))
+	}
+
+	return s.writeFile(s.path("state", key), v)
+}
+
+func (s *FileDBService) removeState(key string) error {
+	if err := os.Remove(s.path("state", key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// consume takes one read of the record whose contents are at path, deleting
+// it and leaving a tombstone if it expired or that was its last read.
+func (s *FileDBService) consume(path, key string, now time.Time) error {
+	st, err := s.readState(key)
+	if err != nil {
+		return err
+	}
+
+	if expiredAt(st.expires, now) {
+		if err := s.deleteRecord(path, key, tombstoneExpired, now); err != nil {
+			return err
+		}
+		return ErrExpired
+	}
+
+	if st.reads > 1 {
+		return s.writeState(key, st.reads-1, st.expires)
+	}
+
+	return s.deleteRecord(path, key, tombstoneBurned, now)
+}
+
+// deleteRecord removes the contents at path and the state of key, leaving a
+// tombstone that records reason.
+func (s *FileDBService) deleteRecord(path, key string, reason byte, now time.Time) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := s.removeState(key); err != nil {
+		return err
+	}
+	return s.putTombstone(key, reason, now)
+}
+
+// deleteMultiDoc removes an expired MultiDoc's copies and the state of each,
+// leaving a tombstone for the whole set.
+func (s *FileDBService) deleteMultiDoc(key string, now time.Time) error {
+	dir := s.path("multidocs", key)
+
+	copies, err := ioutil.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	for _, fi := range copies {
+		if fi.Name() == multiDocBodyName {
+			continue
+		}
+		if err := s.removeState(key + fi.Name()); err != nil {
+			return err
+		}
+	}
+	if err := s.removeState(key); err != nil {
+		return err
+	}
+	if err := s.updateStatus(key, func(st *MultiDocStatus) {
+		st.expire(now)
+	}); err != nil {
+		return err
+	}
+
+	return s.putTombstone(key, tombstoneExpired, now)
+}
+
+// LoadMultiDocStatus returns the status of the MultiDoc stored under id.
+func (s *FileDBService) LoadMultiDocStatus(id uuid.UUID) (*MultiDocStatus, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	key := hex.EncodeToString(id[:])
+	v, err := ioutil.ReadFile(s.path("statuses", key, fsStatusName))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	st, err := parseMultiDocStatus(v)
+	if err != nil {
+		return nil, err
+	}
+
+	names, err := ioutil.ReadDir(s.path("statuses", key))
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range names {
+		b, err := hex.DecodeString(fi.Name())
+		if err != nil {
+			continue
+		}
+		idx, ok := parseMultiDocIndex(b)
+		if !ok {
+			continue
+		}
+
+		v, err := ioutil.ReadFile(s.path("statuses", key, fi.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if st.Copies[idx], err = parseCopyStatus(v); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// fsStatusName is where a MultiDoc's status is stored alongside its copies'.
+// Like multiDocBodyName, it isn't valid hex.
+const fsStatusName = "status"
+
+// updateStatus applies update to the status of the MultiDoc stored under
+// key, if it has one.
+func (s *FileDBService) updateStatus(key string, update func(*MultiDocStatus)) error {
+	path := s.path("statuses", key, fsStatusName)
+
+	v, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	st, err := parseMultiDocStatus(v)
+	if err != nil {
+		return err
+	}
+
+	update(st)
+
+	if v, err = st.marshal(); err != nil {
+		return err
+	}
+	return s.writeFile(path, v)
+}
+
+// recordRead records a read of the copy at idx in the status of the
+// MultiDoc stored under key, if it has one.
+func (s *FileDBService) recordRead(key string, idx uint32, burned bool, now time.Time) error {
+	path := s.path("statuses", key, hex.EncodeToString(multiDocIndex(idx)))
+
+	v, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	c, err := parseCopyStatus(v)
+	if err != nil {
+		return err
+	}
+
+	c.read(burned, now)
+
+	if v, err = c.marshal(); err != nil {
+		return err
+	}
+	return s.writeFile(path, v)
+}
+
+// removeEmptyMultiDoc removes a MultiDoc's directory, body and state once its
+// last copy has been burned, and marks its status finished.
+func (s *FileDBService) removeEmptyMultiDoc(key string, now time.Time) error {
+	names, err := ioutil.ReadDir(s.path("multidocs", key))
+	if err != nil {
+		return err
+	}
+	for _, fi := range names {
+		if fi.Name() != multiDocBodyName {
+			return nil
+		}
+	}
+	if err := os.RemoveAll(s.path("multidocs", key)); err != nil {
+		return err
+	}
+	if err := s.updateStatus(key, func(st *MultiDocStatus) {
+		st.finish(now)
+	}); err != nil {
+		return err
+	}
+	return s.removeState(key)
+}
+
+func (s *FileDBService) putTombstone(key string, reason byte, now time.Time) error {
+	v := make([]byte, 9)
+	v[0] = reason
+	binary.BigEndian.PutUint64(v[1:], uint64(now.UnixNano()))
+
+	return s.writeFile(s.path("tombstones", key), v)
+}
+
+// tombstoneErr is the filesystem counterpart of BoltDBService.tombstoneErr.
+func (s *FileDBService) tombstoneErr(keys ...string) error {
+	for _, key := range keys {
+		v, err := ioutil.ReadFile(s.path("tombstones", key))
+		if err != nil || len(v) != 9 {
+			continue
+		}
+		if err := tombstoneReasonErr(v[0]); err != ErrNotFound {
+			return err
+		}
+	}
+	return ErrNotFound
+}
@@ -0,0 +1,14 @@
+//go:build !unix && !windows
+
+package pasteburn
+
+import (
+	"errors"
+	"os"
+)
+
+// lockFile fails, since there's no file locking to keep two FileDBServices
+// from sharing a directory on this platform.
+func lockFile(f *os.File) error {
+	return errors.New("FileDBService is not supported on this platform")
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package pasteburn
+
+import (
+	"os"
+	"syscall"
+)
+
+// lockFile takes an exclusive lock on f without waiting, returning
+// ErrDirLocked if someone else holds it. Closing f releases it.
+func lockFile(f *os.File) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrDirLocked
+	}
+	return err
+}
@@ -0,0 +1,31 @@
+package pasteburn
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// LockFileEx isn't in the syscall package, so it's loaded the way Bolt does.
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errLockViolation syscall.Errno = 33
+)
+
+// lockFile takes an exclusive lock on f without waiting, returning
+// ErrDirLocked if someone else holds it. Closing f releases it.
+func lockFile(f *os.File) error {
+	var ol syscall.Overlapped
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return nil
+	}
+	if err == errLockViolation {
+		return ErrDirLocked
+	}
+	return err
+}
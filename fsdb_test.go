@@ -0,0 +1,35 @@
+package pasteburn
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// A second FileDBService on the same directory could serve a burned document
+// again, so it must be refused until the first is closed.
+func TestFileDBLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pasteburn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := NewFileDBService(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewFileDBService(dir); err != ErrDirLocked {
+		t.Errorf("Expected ErrDirLocked opening the directory twice, got %v", err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewFileDBService(dir)
+	if err != nil {
+		t.Fatalf("Reopening after Close: %v", err)
+	}
+	again.Close()
+}
@@ -0,0 +1,160 @@
+package pasteburn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	// KDFArgon2id stretches a passphrase with Argon2id.
+	KDFArgon2id KDF = 1
+	// KDFScrypt stretches a passphrase with scrypt.
+	KDFScrypt KDF = 2
+)
+
+// KDFSaltSizeBytes is the length of the random salt generated for each passphrase document.
+const KDFSaltSizeBytes int = 16
+
+// KDFParams holds the cost parameters for the passphrase KDFs.
+// Only the fields for the KDF in use are meaningful.
+type KDFParams struct {
+	// Argon2id passes, memory in KiB and parallelism.
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+
+	// scrypt cost as log2(N), block size and parallelism.
+	LogN uint8
+	R    uint32
+	P    uint32
+}
+
+// A KDFPolicy decides how new passphrase documents are stretched and how
+// expensive a stored header is allowed to make decryption. The limits stop a
+// crafted document from pinning the server's CPU or memory.
+type KDFPolicy struct {
+	KDF    KDF
+	Params KDFParams
+	Max    KDFParams
+}
+
+// DefaultKDFPolicy is used for every passphrase document.
+// Servers may tune it before handling requests.
+var DefaultKDFPolicy = KDFPolicy{
+	KDF: KDFArgon2id,
+	Params: KDFParams{
+		Time:    3,
+		Memory:  64 * 1024,
+		Threads: 4,
+		LogN:    15,
+		R:       8,
+		P:       1,
+	},
+	Max: KDFParams{
+		Time:    10,
+		Memory:  256 * 1024,
+		Threads: 16,
+		LogN:    20,
+		R:       16,
+		P:       4,
+	},
+}
+
+// ErrKDFLimits is returned when a document's stored KDF parameters exceed the server's limits.
+var ErrKDFLimits = errors.New("document key derivation exceeds server limits")
+
+// newKDFParams returns freshly salted, serialized parameters for the policy's KDF
+// along with the key they derive from passphrase.
+func (p KDFPolicy) newKDFParams(passphrase []byte) ([]byte, []byte, error) {
+	salt := make([]byte, KDFSaltSizeBytes)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, nil, err
+	}
+
+	var b bytes.Buffer
+	switch p.KDF {
+	case KDFArgon2id:
+		binary.Write(&b, binary.BigEndian, p.Params.Time)
+		binary.Write(&b, binary.BigEndian, p.Params.Memory)
+		b.WriteByte(p.Params.Threads)
+	case KDFScrypt:
+		b.WriteByte(p.Params.LogN)
+		binary.Write(&b, binary.BigEndian, p.Params.R)
+		binary.Write(&b, binary.BigEndian, p.Params.P)
+	default:
+		return nil, nil, errors.New("unknown KDF")
+	}
+	b.WriteByte(byte(len(salt)))
+	b.Write(salt)
+
+	params := b.Bytes()
+	key, err := p.deriveKey(p.KDF, params, passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return params, key, nil
+}
+
+// deriveKey parses serialized KDF parameters from an envelope header and
+// derives an AES256 key from passphrase, enforcing the policy's limits.
+func (p KDFPolicy) deriveKey(kdf KDF, params []byte, passphrase []byte) ([]byte, error) {
+	r := bytes.NewReader(params)
+
+	var k KDFParams
+	switch kdf {
+	case KDFArgon2id:
+		if err := binary.Read(r, binary.BigEndian, &k.Time); err != nil {
+			return nil, ErrMalformedEnvelope
+		}
+		if err := binary.Read(r, binary.BigEndian, &k.Memory); err != nil {
+			return nil, ErrMalformedEnvelope
+		}
+		if err := binary.Read(r, binary.BigEndian, &k.Threads); err != nil {
+			return nil, ErrMalformedEnvelope
+		}
+		if k.Time == 0 || k.Threads == 0 {
+			return nil, ErrMalformedEnvelope
+		}
+		if k.Time > p.Max.Time || k.Memory > p.Max.Memory || k.Threads > p.Max.Threads {
+			return nil, ErrKDFLimits
+		}
+	case KDFScrypt:
+		if err := binary.Read(r, binary.BigEndian, &k.LogN); err != nil {
+			return nil, ErrMalformedEnvelope
+		}
+		if err := binary.Read(r, binary.BigEndian, &k.R); err != nil {
+			return nil, ErrMalformedEnvelope
+		}
+		if err := binary.Read(r, binary.BigEndian, &k.P); err != nil {
+			return nil, ErrMalformedEnvelope
+		}
+		if k.LogN == 0 || k.R == 0 || k.P == 0 {
+			return nil, ErrMalformedEnvelope
+		}
+		if k.LogN > p.Max.LogN || k.R > p.Max.R || k.P > p.Max.P {
+			return nil, ErrKDFLimits
+		}
+	default:
+		return nil, ErrUnsupportedEnvelope
+	}
+
+	saltLen, err := r.ReadByte()
+	if err != nil || int(saltLen) != r.Len() {
+		return nil, ErrMalformedEnvelope
+	}
+	salt := params[len(params)-int(saltLen):]
+
+	switch kdf {
+	case KDFArgon2id:
+		return argon2.IDKey(passphrase, salt, k.Time, k.Memory, k.Threads, uint32(AES256KeySizeBytes)), nil
+	default:
+		return scrypt.Key(passphrase, salt, 1<<k.LogN, int(k.R), int(k.P), AES256KeySizeBytes)
+	}
+}
@@ -0,0 +1,72 @@
+package pasteburn
+
+import (
+	"bytes"
+	"testing"
+)
+
+// cheapKDFPolicy swaps in low-cost parameters so tests don't spend seconds
+// stretching keys. It returns a func that restores the previous policy.
+func cheapKDFPolicy(kdf KDF) func() {
+	old := DefaultKDFPolicy
+	DefaultKDFPolicy.KDF = kdf
+	DefaultKDFPolicy.Params = KDFParams{Time: 1, Memory: 1024, Threads: 1, LogN: 10, R: 8, P: 1}
+	return func() { DefaultKDFPolicy = old }
+}
+
+func TestPassphraseRoundTrip(t *testing.T) {
+	defer cheapKDFPolicy(KDFArgon2id)()
+
+	for _, kdf := range []KDF{KDFArgon2id, KDFScrypt} {
+		DefaultKDFPolicy.KDF = kdf
+
+		plaintext := []byte("secret")
+		passphrase := []byte("correct horse battery staple")
+
+		d, err := NewDocumentWithPassphrase(plaintext, passphrase)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e, err := ParseEnvelope(d.Contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.KDF != kdf {
+			t.Errorf("Envelope records KDF %d, expected %d", e.KDF, kdf)
+		}
+
+		wrong := &Document{ID: d.ID, Contents: d.Contents}
+		if err := wrong.DecryptInPlace([]byte("incorrect horse")); err != ErrDecrypt {
+			t.Errorf("Expected ErrDecrypt for wrong passphrase, got %v", err)
+		}
+
+		if err := d.DecryptInPlace(passphrase); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(d.Contents, plaintext) {
+			t.Errorf("Passphrase document decrypted to %q", d.Contents)
+		}
+	}
+}
+
+// A passphrase document whose header asks for more work than the server allows must be refused.
+func TestPassphraseKDFLimits(t *testing.T) {
+	defer cheapKDFPolicy(KDFArgon2id)()
+
+	d, err := NewDocumentWithPassphrase([]byte("secret"), []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DefaultKDFPolicy.Max.Memory = DefaultKDFPolicy.Params.Memory - 1
+	if err := d.DecryptInPlace([]byte("hunter2")); err != ErrKDFLimits {
+		t.Errorf("Expected ErrKDFLimits, got %v", err)
+	}
+}
+
+func TestPassphraseEmpty(t *testing.T) {
+	if _, err := NewDocumentWithPassphrase([]byte("secret"), nil); err == nil {
+		t.Error("Expected an error for an empty passphrase")
+	}
+}
@@ -0,0 +1,431 @@
+package pasteburn
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// MemoryDBService implements DatabaseService in memory. Nothing survives a
+// restart, which makes it suited to tests and to deployments that would
+// rather lose unread documents than keep them on disk. MultiDoc statuses are
+// kept marshalled, as they would be stored, with each copy's apart.
+type MemoryDBService struct {
+	mtx          sync.Mutex
+	documents    map[string]*memRecord
+	streams      map[string]*memRecord
+	multiDocs    map[string]*memMultiDoc
+	tombstones   map[string]memTombstone
+	statuses     map[string][]byte
+	copyStatuses map[string]map[uint32][]byte
+}
+
+type memRecord struct {
+	contents []byte
+	reads    int
+	expires  time.Time
+}
+
+type memMultiDoc struct {
+	body    []byte
+	copies  map[uint32]*memRecord
+	expires time.Time
+}
+
+type memTombstone struct {
+	reason byte
+	at     time.Time
+}
+
+// NewMemoryDBService returns an empty MemoryDBService.
+func NewMemoryDBService() *MemoryDBService {
+	return &MemoryDBService{
+		documents:    make(map[string]*memRecord),
+		streams:      make(map[string]*memRecord),
+		multiDocs:    make(map[string]*memMultiDoc),
+		tombstones:   make(map[string]memTombstone),
+		statuses:     make(map[string][]byte),
+		copyStatuses: make(map[string]map[uint32][]byte),
+	}
+}
+
+// Close implements DatabaseService. The contents are kept, so a closed
+// MemoryDBService still works.
+func (s *MemoryDBService) Close() error {
+	return nil
+}
+
+// SaveDocument saves a document.
+func (s *MemoryDBService) SaveDocument(d *Document) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.documents[string(d.ID[:])] = newMemRecord(d.Contents, d.Reads, d.Expires)
+	return nil
+}
+
+// LoadDocument consumes one read of the document stored under id.
+func (s *MemoryDBService) LoadDocument(id uuid.UUID) (*Document, error) {
+	return s.loadDocument(id, string(id[:]))
+}
+
+// SaveBlob saves a blob.
+func (s *MemoryDBService) SaveBlob(d *Document) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.documents[string(blobKey(d.ID))] = newMemRecord(d.Contents, d.Reads, d.Expires)
+	return nil
+}
+
+// LoadBlob consumes one read of the blob stored under id.
+func (s *MemoryDBService) LoadBlob(id uuid.UUID) (*Document, error) {
+	return s.loadDocument(id, string(blobKey(id)))
+}
+
+func (s *MemoryDBService) loadDocument(id uuid.UUID, key string) (*Document, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	contents, err := s.consume(s.documents, key, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return &Document{
+		ID:       id,
+		Contents: contents,
+	}, nil
+}
+
+// SaveMultiDoc saves a MultiDoc.
+func (s *MemoryDBService) SaveMultiDoc(md *MultiDoc) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	m := &memMultiDoc{
+		copies:  make(map[uint32]*memRecord),
+		expires: md.Expires,
+	}
+	if md.Body != nil {
+		m.body = append([]byte{}, md.Body...)
+	}
+	for idx, d := range md.Documents {
+		m.copies[idx] = newMemRecord(d.Contents, md.Reads, time.Time{})
+	}
+	s.multiDocs[string(md.ID[:])] = m
+
+	st, err := newMultiDocStatus(md)
+	if err != nil {
+		return err
+	}
+	if st != nil {
+		v, err := st.marshal()
+		if err != nil {
+			return err
+		}
+		copies := make(map[uint32][]byte)
+		for idx, c := range st.Copies {
+			if copies[idx], err = c.marshal(); err != nil {
+				return err
+			}
+		}
+		s.statuses[string(md.ID[:])] = v
+		s.copyStatuses[string(md.ID[:])] = copies
+	}
+
+	return nil
+}
+
+// LoadMultiDoc consumes one read of the copy at idx of the MultiDoc stored under id.
+func (s *MemoryDBService) LoadMultiDoc(id uuid.UUID, idx uint32) (*Document, []byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := time.Now()
+	key := string(id[:])
+	copyKey := string(multiDocReadsKey(id, idx))
+
+	m, ok := s.multiDocs[key]
+	if !ok {
+		return nil, nil, s.tombstoneErr(copyKey, key)
+	}
+
+	if expiredAt(m.expires, now) {
+		if err := s.expireMultiDoc(key, now); err != nil {
+			return nil, nil, err
+		}
+		return nil, nil, ErrExpired
+	}
+
+	r, ok := m.copies[idx]
+	if !ok {
+		return nil, nil, s.tombstoneErr(copyKey)
+	}
+
+	r.reads--
+	burn := r.reads <= 0
+	if err := s.recordRead(key, idx, burn, now); err != nil {
+		return nil, nil, err
+	}
+	if burn {
+		delete(m.copies, idx)
+		s.tombstones[copyKey] = memTombstone{tombstoneBurned, now}
+		if len(m.copies) == 0 {
+			delete(s.multiDocs, key)
+			if err := s.updateStatus(key, func(st *MultiDocStatus) {
+				st.finish(now)
+			}); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	d := &Document{
+		ID:       id,
+		Contents: append([]byte{}, r.contents...),
+	}
+	if m.body != nil {
+		return d, append([]byte{}, m.body...), nil
+	}
+	return d, nil, nil
+}
+
+// PeekMultiDoc returns the copy at idx of the MultiDoc stored under id and
+// its Body without consuming a read.
+func (s *MemoryDBService) PeekMultiDoc(id uuid.UUID, idx uint32) (*Document, []byte, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	key := string(id[:])
+	copyKey := string(multiDocReadsKey(id, idx))
+
+	m, ok := s.multiDocs[key]
+	if !ok {
+		return nil, nil, s.tombstoneErr(copyKey, key)
+	}
+	if expiredAt(m.expires, time.Now()) {
+		return nil, nil, ErrExpired
+	}
+	r, ok := m.copies[idx]
+	if !ok {
+		return nil, nil, s.tombstoneErr(copyKey)
+	}
+
+	d := &Document{
+		ID:       id,
+		Contents: append([]byte{}, r.contents...),
+	}
+	if m.body != nil {
+		return d, append([]byte{}, m.body...), nil
+	}
+	return d, nil, nil
+}
+
+// SaveStream saves everything read from r. Being in memory, it's held in full.
+func (s *MemoryDBService) SaveStream(d *Document, r io.Reader) error {
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.streams[string(d.ID[:])] = &memRecord{
+		contents: contents,
+		reads:    maxInt(d.Reads, 1),
+		expires:  d.Expires,
+	}
+	return nil
+}
+
+// LoadStream consumes one read of the stream stored under id.
+func (s *MemoryDBService) LoadStream(id uuid.UUID) (io.ReadCloser, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	contents, err := s.consume(s.streams, string(id[:]), time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(contents)), nil
+}
+
+// PurgeExpired deletes every record whose deadline is at or before now and
+// drops tombstones and MultiDoc statuses once they've outlived tombstoneTTL.
+func (s *MemoryDBService) PurgeExpired(now time.Time) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	purged := 0
+	for _, records := range []map[string]*memRecord{s.documents, s.streams} {
+		for key, r := range records {
+			if expiredAt(r.expires, now) {
+				delete(records, key)
+				s.tombstones[key] = memTombstone{tombstoneExpired, now}
+				purged++
+			}
+		}
+	}
+	for key, m := range s.multiDocs {
+		if expiredAt(m.expires, now) {
+			if err := s.expireMultiDoc(key, now); err != nil {
+				return purged, err
+			}
+			purged++
+		}
+	}
+	for key, t := range s.tombstones {
+		if !t.at.Add(tombstoneTTL).After(now) {
+			delete(s.tombstones, key)
+		}
+	}
+	for key, v := range s.statuses {
+		st, err := parseMultiDocStatus(v)
+		if err != nil {
+			return purged, err
+		}
+		if st.stale(now) {
+			delete(s.statuses, key)
+			delete(s.copyStatuses, key)
+		}
+	}
+
+	return purged, nil
+}
+
+// LoadMultiDocStatus returns the status of the MultiDoc stored under id.
+func (s *MemoryDBService) LoadMultiDocStatus(id uuid.UUID) (*MultiDocStatus, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	key := string(id[:])
+	v, ok := s.statuses[key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	st, err := parseMultiDocStatus(v)
+	if err != nil {
+		return nil, err
+	}
+
+	for idx, v := range s.copyStatuses[key] {
+		if st.Copies[idx], err = parseCopyStatus(v); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// expireMultiDoc deletes the MultiDoc stored under key, leaving a tombstone.
+func (s *MemoryDBService) expireMultiDoc(key string, now time.Time) error {
+	delete(s.multiDocs, key)
+	s.tombstones[key] = memTombstone{tombstoneExpired, now}
+
+	return s.updateStatus(key, func(st *MultiDocStatus) {
+		st.expire(now)
+	})
+}
+
+// updateStatus applies update to the status of the MultiDoc stored under
+// key, if it has one.
+func (s *MemoryDBService) updateStatus(key string, update func(*MultiDocStatus)) error {
+	v, ok := s.statuses[key]
+	if !ok {
+		return nil
+	}
+	st, err := parseMultiDocStatus(v)
+	if err != nil {
+		return err
+	}
+
+	update(st)
+
+	if v, err = st.marshal(); err != nil {
+		return err
+	}
+	s.statuses[key] = v
+	return nil
+}
+
+// recordRead records a read of the copy at idx in the status of the MultiDoc
+// stored under key, if it has one.
+func (s *MemoryDBService) recordRead(key string, idx uint32, burned bool, now time.Time) error {
+	v, ok := s.copyStatuses[key][idx]
+	if !ok {
+		return nil
+	}
+	c, err := parseCopyStatus(v)
+	if err != nil {
+		return err
+	}
+
+	c.read(burned, now)
+
+	if v, err = c.marshal(); err != nil {
+		return err
+	}
+	s.copyStatuses[key][idx] = v
+	return nil
+}
+
+// consume takes one read of records[key], deleting it and leaving a
+// tombstone if it expired or that was its last read.
+func (s *MemoryDBService) consume(records map[string]*memRecord, key string, now time.Time) ([]byte, error) {
+	r, ok := records[key]
+	if !ok {
+		return nil, s.tombstoneErr(key)
+	}
+
+	if expiredAt(r.expires, now) {
+		delete(records, key)
+		s.tombstones[key] = memTombstone{tombstoneExpired, now}
+		return nil, ErrExpired
+	}
+
+	r.reads--
+	if r.reads <= 0 {
+		delete(records, key)
+		s.tombstones[key] = memTombstone{tombstoneBurned, now}
+	}
+
+	return append([]byte{}, r.contents...), nil
+}
+
+// tombstoneErr is the in-memory counterpart of BoltDBService.tombstoneErr.
+func (s *MemoryDBService) tombstoneErr(keys ...string) error {
+	for _, key := range keys {
+		if t, ok := s.tombstones[key]; ok {
+			return tombstoneReasonErr(t.reason)
+		}
+	}
+	return ErrNotFound
+}
+
+// newMemRecord copies contents, since callers may reuse their slices.
+func newMemRecord(contents []byte, reads int, expires time.Time) *memRecord {
+	return &memRecord{
+		contents: append([]byte{}, contents...),
+		reads:    maxInt(reads, 1),
+		expires:  expires,
+	}
+}
+
+// expiredAt reports whether a record with the given deadline has expired by now.
+// A zero deadline never expires.
+func expiredAt(expires time.Time, now time.Time) bool {
+	return !expires.IsZero() && !expires.After(now)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,90 @@
+package pasteburn
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// Metadata describes a document. It's encrypted under the document's key and
+// authenticated together with the body, so none of it is ever stored in the
+// clear.
+//
+// In version 2 envelopes the plaintext starts with a metadata section: a 4
+// byte big endian length followed by the Metadata as JSON, or nothing if the
+// length is zero. The body follows. Version 1 envelopes have no section and
+// decrypt to empty Metadata.
+type Metadata struct {
+	// Name is the original file name, without any directories.
+	Name string `json:"name,omitempty"`
+	// Type is the MIME type the document was uploaded with.
+	Type string `json:"type,omitempty"`
+	// Size is the length of the body in bytes, if known when it was encrypted.
+	Size int64 `json:"size,omitempty"`
+	// Title and Note are free text from the creator.
+	Title string `json:"title,omitempty"`
+	Note  string `json:"note,omitempty"`
+}
+
+// maxMetadataSize bounds the encoded Metadata a reader will accept.
+const maxMetadataSize = 64 * 1024
+
+// metadataVersion is the first envelope version with a metadata section.
+const metadataVersion byte = 2
+
+// appendMetadata appends the metadata section for m to b.
+func appendMetadata(b []byte, m *Metadata) ([]byte, error) {
+	var encoded []byte
+	if m != nil && *m != (Metadata{}) {
+		var err error
+		if encoded, err = json.Marshal(m); err != nil {
+			return nil, err
+		}
+	}
+	if len(encoded) > maxMetadataSize {
+		return nil, errors.New("document metadata is too large")
+	}
+
+	prefix := make([]byte, 4)
+	binary.BigEndian.PutUint32(prefix, uint32(len(encoded)))
+
+	return append(append(b, prefix...), encoded...), nil
+}
+
+// readMetadata reads a metadata section from the start of a plaintext.
+func readMetadata(r io.Reader) (*Metadata, error) {
+	prefix := make([]byte, 4)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, metadataErr(err)
+	}
+
+	n := binary.BigEndian.Uint32(prefix)
+	if n > maxMetadataSize {
+		return nil, ErrMalformedEnvelope
+	}
+
+	m := &Metadata{}
+	if n == 0 {
+		return m, nil
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, metadataErr(err)
+	}
+	if err := json.Unmarshal(b, m); err != nil || m.Size < 0 {
+		return nil, ErrMalformedEnvelope
+	}
+
+	return m, nil
+}
+
+// metadataErr passes on decryption errors, which explain a short read better
+// than the section itself being malformed.
+func metadataErr(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrMalformedEnvelope
+	}
+	return err
+}
@@ -0,0 +1,94 @@
+package pasteburn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// Metadata must round trip with the body without ever appearing in the stored bytes.
+func TestMetadataEncrypted(t *testing.T) {
+	key := []byte("11112222333344445555666677778888")
+	id, _ := uuid.NewV4()
+	meta := Metadata{
+		Name:  "payroll.xlsx",
+		Type:  "application/vnd.ms-excel",
+		Size:  6,
+		Title: "quarterly numbers",
+		Note:  "delete after reading",
+	}
+
+	d := &Document{ID: *id, Contents: []byte("secret"), Metadata: meta}
+	if err := d.EncryptInPlace(key); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{meta.Name, meta.Type, meta.Title, meta.Note} {
+		if bytes.Contains(d.Contents, []byte(s)) {
+			t.Errorf("Stored document contains %q in the clear", s)
+		}
+	}
+
+	stored := &Document{ID: d.ID, Contents: d.Contents}
+	if err := stored.DecryptInPlace(key); err != nil {
+		t.Fatal(err)
+	}
+	if stored.Metadata != meta {
+		t.Errorf("Metadata decrypted to %+v, expected %+v", stored.Metadata, meta)
+	}
+	if string(stored.Contents) != "secret" {
+		t.Errorf("Body decrypted to %q", stored.Contents)
+	}
+}
+
+// Version 1 envelopes have no metadata section and must decrypt unchanged.
+func TestMetadataVersion1(t *testing.T) {
+	key := []byte("11112222333344445555666677778888")
+	id, _ := uuid.NewV4()
+	d := &Document{ID: *id}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &Envelope{
+		Version:   1,
+		Algorithm: AlgAES256GCM,
+		Nonce:     make([]byte, aead.NonceSize()),
+	}
+	rand.Read(e.Nonce)
+	e.Ciphertext = aead.Seal(nil, e.Nonce, []byte("secret"), d.associatedData(e))
+	d.Contents, _ = e.MarshalBinary()
+
+	if err := d.DecryptInPlace(key); err != nil {
+		t.Fatal(err)
+	}
+	if string(d.Contents) != "secret" || d.Metadata != (Metadata{}) {
+		t.Errorf("Version 1 document decrypted to %q with metadata %+v", d.Contents, d.Metadata)
+	}
+}
+
+func TestMetadataStream(t *testing.T) {
+	key := []byte("11112222333344445555666677778888")
+	id, _ := uuid.NewV4()
+	meta := &Metadata{Name: "clip.mp4", Type: "video/mp4", Size: 3}
+
+	var buf bytes.Buffer
+	w, err := NewEncryptWriter(&buf, *id, key, meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("abc"))
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _, err := NewDecryptReader(bytes.NewReader(buf.Bytes()), *id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *meta {
+		t.Errorf("Stream metadata decrypted to %+v, expected %+v", got, meta)
+	}
+}
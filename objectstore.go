@@ -0,0 +1,133 @@
+package pasteburn
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An ObjectStore is the subset of an S3-compatible object store that
+// S3DBService needs. ETags are opaque and passed back exactly as returned.
+// An empty ifMatch makes a write unconditional.
+type ObjectStore interface {
+	// GetObject returns an object's contents and ETag, or ErrObjectNotFound.
+	GetObject(key string) ([]byte, string, error)
+	// PutObject stores an object. With ifMatch set it fails with
+	// ErrPreconditionFailed unless the object's current ETag is ifMatch.
+	PutObject(key string, data []byte, ifMatch string) error
+	// DeleteObject deletes an object. Unconditional deletes of missing objects
+	// succeed; with ifMatch set it fails with ErrObjectNotFound or
+	// ErrPreconditionFailed unless the object's current ETag is ifMatch.
+	DeleteObject(key string, ifMatch string) error
+	// ListObjects returns every object whose key starts with prefix, in key order.
+	ListObjects(prefix string) ([]ObjectInfo, error)
+}
+
+// ObjectInfo describes a listed object.
+type ObjectInfo struct {
+	Key          string
+	LastModified time.Time
+}
+
+var (
+	// ErrObjectNotFound is returned by an ObjectStore for a missing object.
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrPreconditionFailed is returned by an ObjectStore when a conditional
+	// write loses to another writer.
+	ErrPreconditionFailed = errors.New("object precondition failed")
+)
+
+// MemoryObjectStore is an in-process ObjectStore with the same conditional
+// semantics as S3, for tests and single-replica experiments.
+type MemoryObjectStore struct {
+	mtx     sync.Mutex
+	objects map[string]memObject
+	version int
+}
+
+type memObject struct {
+	data         []byte
+	etag         string
+	lastModified time.Time
+}
+
+// NewMemoryObjectStore returns an empty MemoryObjectStore.
+func NewMemoryObjectStore() *MemoryObjectStore {
+	return &MemoryObjectStore{objects: make(map[string]memObject)}
+}
+
+// GetObject implements ObjectStore.
+func (m *MemoryObjectStore) GetObject(key string) ([]byte, string, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	o, ok := m.objects[key]
+	if !ok {
+		return nil, "", ErrObjectNotFound
+	}
+	return append([]byte{}, o.data...), o.etag, nil
+}
+
+// PutObject implements ObjectStore.
+func (m *MemoryObjectStore) PutObject(key string, data []byte, ifMatch string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if err := m.check(key, ifMatch); err != nil {
+		return err
+	}
+
+	m.version++
+	m.objects[key] = memObject{
+		data:         append([]byte{}, data...),
+		etag:         fmt.Sprintf(`"%d"`, m.version),
+		lastModified: time.Now(),
+	}
+	return nil
+}
+
+// DeleteObject implements ObjectStore.
+func (m *MemoryObjectStore) DeleteObject(key string, ifMatch string) error {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	if err := m.check(key, ifMatch); err != nil {
+		return err
+	}
+
+	delete(m.objects, key)
+	return nil
+}
+
+// ListObjects implements ObjectStore.
+func (m *MemoryObjectStore) ListObjects(prefix string) ([]ObjectInfo, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	var infos []ObjectInfo
+	for key, o := range m.objects {
+		if strings.HasPrefix(key, prefix) {
+			infos = append(infos, ObjectInfo{Key: key, LastModified: o.lastModified})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+
+	return infos, nil
+}
+
+func (m *MemoryObjectStore) check(key string, ifMatch string) error {
+	if ifMatch == "" {
+		return nil
+	}
+	o, ok := m.objects[key]
+	if !ok {
+		return ErrObjectNotFound
+	}
+	if o.etag != ifMatch {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
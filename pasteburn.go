@@ -2,7 +2,9 @@ package pasteburn
 
 import (
 	"crypto/rand"
-	"crypto/sha256"
+	"errors"
+	"io"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -16,13 +18,30 @@ type Service interface {
 	GetDocument(ctx context.Context, id uuid.UUID, key []byte) (*Document, error)
 	PostMultiDoc(ctx context.Context, d *MultiDoc) error
 	GetMultiDoc(ctx context.Context, id uuid.UUID, key []byte) (*Document, error)
+	CombineShares(ctx context.Context, id uuid.UUID, keys [][]byte) ([]byte, error)
+	GetMultiDocStatus(ctx context.Context, id uuid.UUID, token []byte) (*MultiDocStatus, error)
+	PostBlob(ctx context.Context, d *Document) error
+	GetBlob(ctx context.Context, id uuid.UUID) (*Document, error)
+	PostStream(ctx context.Context, d *Document, r io.Reader) error
+	GetStream(ctx context.Context, id uuid.UUID, key []byte) (*Metadata, io.ReadCloser, error)
 }
 
-// BoltBackedService uses Boltdb to implement Service
-type BoltBackedService struct {
-	db *BoltDBService
+// DBBackedService implements Service on top of any DatabaseService.
+// MaxTTL caps how long any document may live unread; zero means no cap.
+// Logger receives everything the service logs and defaults to the standard logrus logger.
+type DBBackedService struct {
+	db DatabaseService
+
+	MaxTTL time.Duration
+	Logger log.FieldLogger
 }
 
+// BoltBackedService is the name DBBackedService had when Bolt was the only
+// backend.
+//
+// Deprecated: Use DBBackedService.
+type BoltBackedService = DBBackedService
+
 // GenerateKey returns a random AES256 key.
 func GenerateKey() ([]byte, error) {
 	key := make([]byte, AES256KeySizeBytes)
@@ -33,51 +52,70 @@ func GenerateKey() ([]byte, error) {
 	return key, nil
 }
 
-// NewBoltBackedService returns an initialized Service
-func NewBoltBackedService(dbPath string) (*BoltBackedService, error) {
+// NewDBBackedService returns a Service storing documents in db, which it
+// closes when the service is closed.
+func NewDBBackedService(db DatabaseService) *DBBackedService {
+	return &DBBackedService{
+		db:     db,
+		Logger: log.StandardLogger(),
+	}
+}
+
+// NewBoltBackedService returns a Service backed by the Bolt database at dbPath.
+func NewBoltBackedService(dbPath string) (*DBBackedService, error) {
 	dbSvc, err := NewBoltDBService(dbPath)
 	if err != nil {
 		return nil, err
 	}
 
-	return &BoltBackedService{
-		db: dbSvc,
-	}, nil
+	return NewDBBackedService(dbSvc), nil
+}
+
+// logger returns the service's Logger with redaction applied to every field,
+// so nothing the service logs can leak key material or document contents.
+func (s *DBBackedService) logger() log.FieldLogger {
+	return redactingLogger{s.Logger}
+}
+
+// Close releases the service's database.
+func (s *DBBackedService) Close() error {
+	return s.db.Close()
 }
 
 // PostDocument handles posting a document to the DB
-func (s *BoltBackedService) PostDocument(ctx context.Context, d *Document) error {
-	if err := d.SaveDoc(*s.db); err != nil {
+func (s *DBBackedService) PostDocument(ctx context.Context, d *Document) error {
+	d.Expires = s.capExpiry(d.Expires)
+	if err := d.SaveDoc(s.db); err != nil {
+		s.logger().WithFields(log.Fields{
+			"id": d.ID,
+		}).Error("Failed to save document:", err)
 		return err
 	}
 	return nil
 }
 
-// GetDocument returns the note with the given id, decrypted using key
-func (s *BoltBackedService) GetDocument(ctx context.Context, id uuid.UUID, key []byte) (*Document, error) {
+// GetDocument returns the note with the given id, decrypted using key.
+// It returns ErrNotFound, ErrBurned or ErrExpired if there's nothing to read
+// and ErrDecrypt if the key is wrong.
+func (s *DBBackedService) GetDocument(ctx context.Context, id uuid.UUID, key []byte) (*Document, error) {
 
-	d, err := (*s.db).LoadDocument(id)
+	d, err := s.db.LoadDocument(id)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"id": "id",
-		}).Fatal("Failed to load document:", err)
-		return d, err
+		s.logger().WithFields(log.Fields{
+			"id": id,
+		}).Debug("Failed to load document:", err)
+		return nil, err
 	}
 
-	log.WithFields(log.Fields{
+	s.logger().WithFields(log.Fields{
 		"id": id,
 	}).Debug("Loaded encrypted document")
 
-	if len(d.Contents) == 0 {
-		// TODO Document has been deleted how to handle this better?
-		return d, nil
-	}
-
 	if err := d.DecryptInPlace(key); err != nil {
-		log.WithFields(log.Fields{
-			"id":      id,
-			"keyHash": sha256.Sum256(key),
-		}).Fatal("Failed to decrypt document")
+		s.logger().WithFields(log.Fields{
+			"id":             id,
+			"keyFingerprint": KeyFingerprint(key),
+		}).Warn("Failed to decrypt document:", err)
 		return nil, err
 	}
 
@@ -85,34 +123,296 @@ func (s *BoltBackedService) GetDocument(ctx context.Context, id uuid.UUID, key [
 }
 
 // PostMultiDoc handles posting a document to the DB
-func (s *BoltBackedService) PostMultiDoc(ctx context.Context, d *MultiDoc) error {
-	if err := d.SaveMD(*s.db); err != nil {
+func (s *DBBackedService) PostMultiDoc(ctx context.Context, d *MultiDoc) error {
+	d.Expires = s.capExpiry(d.Expires)
+	if err := d.SaveMD(s.db); err != nil {
+		s.logger().WithFields(log.Fields{
+			"id": d.ID,
+		}).Error("Failed to save multidoc:", err)
 		return err
 	}
 	return nil
 }
 
 // GetMultiDoc loads a single instance of a document given a key.
-// The key's first byte which specifies which copy of the doc to load
-func (s *BoltBackedService) GetMultiDoc(ctx context.Context, id uuid.UUID, key []byte) (*Document, error) {
+// The key starts with the index of the copy to load, see NewMultiDoc.
+// Errors are the same as GetDocument's.
+func (s *DBBackedService) GetMultiDoc(ctx context.Context, id uuid.UUID, key []byte) (*Document, error) {
+	idx, encKey, err := parseMultiDocKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	d, body, err := s.db.LoadMultiDoc(id, idx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.DecryptInPlace(encKey)
+	if err == nil && body != nil {
+		// The copy was the body's data key, wrapped under encKey.
+		dataKey := d.Contents
+		d = &Document{
+			ID:       id,
+			Contents: body,
+		}
+		err = d.DecryptInPlace(dataKey)
+	}
+	if err != nil {
+		s.logger().WithFields(log.Fields{
+			"id":             id,
+			"idx":            idx,
+			"keyFingerprint": KeyFingerprint(encKey),
+		}).Warn("Failed to decrypt multidoc copy:", err)
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// GetMultiDocStatus returns the status of a MultiDoc created with a status
+// token, given that token, with its labels decrypted. Any other token gets
+// ErrDecrypt.
+func (s *DBBackedService) GetMultiDocStatus(ctx context.Context, id uuid.UUID, token []byte) (*MultiDocStatus, error) {
+	st, err := s.db.LoadMultiDocStatus(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if !st.authorize(token) {
+		s.logger().WithFields(log.Fields{
+			"id":             id,
+			"keyFingerprint": KeyFingerprint(token),
+		}).Warn("Wrong status token for multidoc")
+		return nil, ErrDecrypt
+	}
+
+	if err := st.openLabels(id, token); err != nil {
+		return nil, err
+	}
+
+	return st, nil
+}
+
+// CombineShares decrypts the Body of a NewShamirMultiDoc with the data key
+// reconstructed from the shares that keys unlock, then burns those shares.
+// Every share is checked first without consuming it, so a combine that fails
+// for any reason, whether too few shares for the threshold stored with the
+// Body, a wrong key, or shares that reconstruct the wrong key (ErrDecrypt),
+// burns nothing.
+func (s *DBBackedService) CombineShares(ctx context.Context, id uuid.UUID, keys [][]byte) ([]byte, error) {
+	if len(keys) == 0 {
+		return nil, ErrNotEnoughShares
+	}
+
+	seen := make(map[byte]bool)
+	for _, key := range keys {
+		idx, _, _, err := parseShareKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if seen[idx] {
+			return nil, ErrNotEnoughShares
+		}
+		seen[idx] = true
+	}
+
+	first, _, _, _ := parseShareKey(keys[0])
+	_, body, err := s.db.PeekMultiDoc(id, uint32(first))
+	if err != nil {
+		return nil, err
+	}
+	threshold, err := shamirThreshold(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) < int(threshold) {
+		return nil, ErrNotEnoughShares
+	}
+	for _, key := range keys {
+		// The keys' own threshold is only a hint for clients, but one that
+		// disagrees with the server's means they're from another split.
+		if _, t, _, _ := parseShareKey(key); t != threshold {
+			return nil, ErrNotEnoughShares
+		}
+	}
 
-	idx := key[0]
-	encKey := make([]byte, len(key)-1)
-	copy(encKey, key[1:])
+	shares := make(map[byte][]byte)
+	for _, key := range keys {
+		idx, _, encKey, _ := parseShareKey(key)
+
+		d, _, err := s.db.PeekMultiDoc(id, uint32(idx))
+		if err == nil {
+			err = d.DecryptInPlace(encKey)
+		}
+		if err != nil {
+			s.logger().WithFields(log.Fields{
+				"id":             id,
+				"idx":            idx,
+				"keyFingerprint": KeyFingerprint(encKey),
+			}).Warn("Failed to read share:", err)
+			return nil, err
+		}
+		shares[idx+1] = d.Contents
+	}
 
-	d, err := (*s.db).LoadMultiDoc(id, idx)
+	dataKey, err := combineShares(shares)
 	if err != nil {
-		return d, err
+		return nil, err
 	}
 
-	if len(d.Contents) == 0 {
-		// TODO Document has been deleted how to handle this better?
-		return d, nil
+	d := &Document{
+		ID:       id,
+		Contents: body,
+	}
+	if err := d.DecryptInPlace(dataKey); err != nil {
+		s.logger().WithField("id", id).Warn("Failed to decrypt combined shares:", err)
+		return nil, err
 	}
 
-	if err = d.DecryptInPlace(encKey); err != nil {
-		return d, err
+	// Only now are the shares consumed. One that's gone since it was checked
+	// was consumed by a concurrent request, and the secret mustn't be handed
+	// out again.
+	for idx := range shares {
+		if _, _, err := s.db.LoadMultiDoc(id, uint32(idx-1)); err != nil {
+			return nil, err
+		}
 	}
 
+	return d.Contents, nil
+}
+
+// PostBlob stores a document that the server can't decrypt, such as one
+// encrypted by the client. Its contents are saved exactly as given, apart
+// from documents, so GetDocument never sees it and GetBlob sees nothing else.
+func (s *DBBackedService) PostBlob(ctx context.Context, d *Document) error {
+	if !d.Encrypted {
+		return errors.New("Tried to post a blob that isn't marked encrypted")
+	}
+	d.Expires = s.capExpiry(d.Expires)
+	if err := s.db.SaveBlob(d); err != nil {
+		s.logger().WithFields(log.Fields{
+			"id": d.ID,
+		}).Error("Failed to save blob:", err)
+		return err
+	}
+	return nil
+}
+
+// GetBlob returns a blob saved with PostBlob verbatim, burning it like any
+// other document. Documents the server encrypted aren't blobs and are
+// ErrNotFound here, so their envelopes can't be fetched for offline guessing.
+func (s *DBBackedService) GetBlob(ctx context.Context, id uuid.UUID) (*Document, error) {
+	d, err := s.db.LoadBlob(id)
+	if err != nil {
+		return nil, err
+	}
+
+	d.Encrypted = true
+
 	return d, nil
 }
+
+// PostStream stores a large document whose encrypted envelope is read from r,
+// typically the output of NewEncryptWriter. Only d's ID, Reads and Expires are
+// used; the stream is stored in chunks and never held in memory in full.
+func (s *DBBackedService) PostStream(ctx context.Context, d *Document, r io.Reader) error {
+	d.Expires = s.capExpiry(d.Expires)
+	if err := s.db.SaveStream(d, r); err != nil {
+		s.logger().WithFields(log.Fields{
+			"id": d.ID,
+		}).Error("Failed to save stream:", err)
+		return err
+	}
+	return nil
+}
+
+// GetStream returns the metadata of a document stored with PostStream and a
+// reader of its decrypted contents, which must be closed. The first segment is
+// authenticated before GetStream returns, so a wrong key is reported as
+// ErrDecrypt here rather than partway through the stream. Other errors are the
+// same as GetDocument's.
+func (s *DBBackedService) GetStream(ctx context.Context, id uuid.UUID, key []byte) (*Metadata, io.ReadCloser, error) {
+	rc, err := s.db.LoadStream(id)
+	if err != nil {
+		s.logger().WithFields(log.Fields{
+			"id": id,
+		}).Debug("Failed to load stream:", err)
+		return nil, nil, err
+	}
+
+	m, plain, err := NewDecryptReader(rc, id, key)
+	if err != nil {
+		rc.Close()
+		s.logger().WithFields(log.Fields{
+			"id":             id,
+			"keyFingerprint": KeyFingerprint(key),
+		}).Warn("Failed to decrypt stream:", err)
+		return nil, nil, err
+	}
+
+	return m, &streamReader{
+		r:      plain,
+		Closer: rc,
+		id:     id,
+		logger: s.logger(),
+	}, nil
+}
+
+// streamReader is the reader GetStream returns. It logs a failure partway
+// through the stream, which callers can usually only react to by aborting.
+type streamReader struct {
+	r io.Reader
+	io.Closer
+
+	id     uuid.UUID
+	logger log.FieldLogger
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	n, err := sr.r.Read(p)
+	if err != nil && err != io.EOF {
+		sr.logger.WithFields(log.Fields{
+			"id": sr.id,
+		}).Error("Failed partway through a stream:", err)
+	}
+	return n, err
+}
+
+// capExpiry clamps a requested expiry time to MaxTTL from now.
+// Documents without an expiry get the maximum when there is one.
+func (s *DBBackedService) capExpiry(expires time.Time) time.Time {
+	if s.MaxTTL <= 0 {
+		return expires
+	}
+
+	latest := time.Now().Add(s.MaxTTL)
+	if expires.IsZero() || expires.After(latest) {
+		return latest
+	}
+
+	return expires
+}
+
+// Sweep purges expired documents every interval until ctx is done.
+// Expired documents are already unreadable; sweeping reclaims their space.
+func (s *DBBackedService) Sweep(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			n, err := s.db.PurgeExpired(now)
+			if err != nil {
+				s.logger().WithField("function", "Sweep").Error("Failed to purge expired documents:", err)
+				continue
+			}
+			if n > 0 {
+				s.logger().WithField("purged", n).Info("Purged expired documents")
+			}
+		}
+	}
+}
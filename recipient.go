@@ -0,0 +1,107 @@
+package pasteburn
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+// KDFX25519 derives the key from an X25519 exchange between a recipient's
+// key pair and an ephemeral one generated for each document, in the manner of
+// age. The envelope's KDFParams hold the ephemeral public key; the key given
+// to decrypt is the recipient's private key.
+const KDFX25519 KDF = 3
+
+// X25519KeySizeBytes is the length of X25519 public and private keys.
+const X25519KeySizeBytes int = curve25519.ScalarSize
+
+// x25519Info separates keys derived here from any other use of the same
+// shared secret.
+var x25519Info = []byte("pasteburn X25519")
+
+// GenerateRecipientKey returns a new X25519 key pair for receiving documents
+// encrypted with EncryptToRecipient.
+func GenerateRecipientKey() (public, private []byte, err error) {
+	private = make([]byte, X25519KeySizeBytes)
+	if _, err := io.ReadFull(rand.Reader, private); err != nil {
+		return nil, nil, err
+	}
+
+	public, err = RecipientPublicKey(private)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return public, private, nil
+}
+
+// RecipientPublicKey returns the public key for an X25519 private key.
+func RecipientPublicKey(private []byte) ([]byte, error) {
+	if len(private) != X25519KeySizeBytes {
+		return nil, ErrKeyLength
+	}
+	return curve25519.X25519(private, curve25519.Basepoint)
+}
+
+// EncryptToRecipient is like EncryptInPlace, but only the holder of the
+// private key for public can decrypt the document. The server never sees a
+// key that would let it read the document back.
+func (d *Document) EncryptToRecipient(public []byte) error {
+	if len(public) != X25519KeySizeBytes {
+		return ErrKeyLength
+	}
+
+	ephemeralPublic, ephemeral, err := GenerateRecipientKey()
+	if err != nil {
+		return err
+	}
+
+	shared, err := curve25519.X25519(ephemeral, public)
+	if err != nil {
+		return ErrKeyLength
+	}
+
+	key, err := x25519Key(shared, ephemeralPublic, public)
+	if err != nil {
+		return err
+	}
+
+	return d.seal(key, KDFX25519, ephemeralPublic)
+}
+
+// recipientKey derives the AES256 key for an envelope encrypted with
+// EncryptToRecipient from the recipient's private key.
+func recipientKey(params []byte, private []byte) ([]byte, error) {
+	if len(params) != X25519KeySizeBytes {
+		return nil, ErrMalformedEnvelope
+	}
+
+	public, err := RecipientPublicKey(private)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	// X25519 rejects ephemeral keys of low order, whose shared secret would
+	// be all zeros whatever the private key.
+	shared, err := curve25519.X25519(private, params)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+
+	return x25519Key(shared, params, public)
+}
+
+// x25519Key stretches a shared secret into an AES256 key, binding both public
+// keys so it can't be reused with either key pair swapped out.
+func x25519Key(shared, ephemeralPublic, public []byte) ([]byte, error) {
+	salt := append(append([]byte{}, ephemeralPublic...), public...)
+
+	key := make([]byte, AES256KeySizeBytes)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, x25519Info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
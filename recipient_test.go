@@ -0,0 +1,125 @@
+package pasteburn
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	uuid "github.com/nu7hatch/gouuid"
+	"golang.org/x/net/context"
+)
+
+func TestRecipientRoundTrip(t *testing.T) {
+	public, private, err := GenerateRecipientKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, other, err := GenerateRecipientKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := &Document{Contents: []byte("secret"), Metadata: Metadata{Title: "for you"}}
+	if err := d.EncryptToRecipient(public); err != nil {
+		t.Fatal(err)
+	}
+	sealed := append([]byte{}, d.Contents...)
+
+	if err := d.DecryptInPlace(other); err != ErrDecrypt {
+		t.Errorf("Expected ErrDecrypt for another private key, got %v", err)
+	}
+	if err := d.DecryptInPlace(public); err != ErrDecrypt {
+		t.Errorf("Expected ErrDecrypt for the public key, got %v", err)
+	}
+
+	// Swapping in another ephemeral key must be caught as tampering.
+	e, err := ParseEnvelope(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.KDFParams, _, _ = GenerateRecipientKey()
+	tampered, err := e.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Document{ID: d.ID, Contents: tampered}).DecryptInPlace(private); err != ErrDecrypt {
+		t.Errorf("Expected ErrDecrypt for a swapped ephemeral key, got %v", err)
+	}
+
+	if err := d.DecryptInPlace(private); err != nil {
+		t.Fatal(err)
+	}
+	if string(d.Contents) != "secret" || d.Metadata.Title != "for you" {
+		t.Errorf("Decrypted %q titled %q", d.Contents, d.Metadata.Title)
+	}
+
+	if err := (&Document{}).EncryptToRecipient(public[1:]); err != ErrKeyLength {
+		t.Errorf("Expected ErrKeyLength for a short public key, got %v", err)
+	}
+}
+
+// A document created for a recipient must only be readable as an envelope,
+// which their private key decrypts.
+func TestRecipientCreate(t *testing.T) {
+	s := NewDBBackedService(NewMemoryDBService())
+	ctx := context.Background()
+
+	public, private, err := GenerateRecipientKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, _ := json.Marshal(map[string]string{"Body": "secret", "Recipient": EncodeShareKey(public)})
+	rec := httptest.NewRecorder()
+	MakeTextAddHandler(ctx, s)(rec, httptest.NewRequest("POST", "/api/text/create", bytes.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Create returned status %d: %s", rec.Code, rec.Body)
+	}
+
+	var res struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Key != "" {
+		t.Error("Create returned a key for a recipient's document")
+	}
+	u, err := url.Parse(res.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Path != "/api/blob/view" || u.Query().Get("k") != "" {
+		t.Errorf("Create returned link %s, expected a blob view without a key", res.URL)
+	}
+
+	rec = httptest.NewRecorder()
+	MakeBlobViewHandler(ctx, s)(rec, httptest.NewRequest("GET", u.RequestURI(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Blob view returned status %d: %s", rec.Code, rec.Body)
+	}
+
+	id, err := uuid.ParseHex(res.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &Document{ID: *id, Contents: rec.Body.Bytes(), Encrypted: true}
+	if err := d.DecryptInPlace(private); err != nil {
+		t.Fatal(err)
+	}
+	if string(d.Contents) != "secret" {
+		t.Errorf("Decrypted %q, expected %q", d.Contents, "secret")
+	}
+
+	rec = httptest.NewRecorder()
+	MakeTextAddHandler(ctx, s)(rec, httptest.NewRequest("POST", "/api/text/create",
+		bytes.NewBufferString(`{"Body": "secret", "Recipient": "c2hvcnQ"}`)))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Creating for a malformed recipient returned status %d", rec.Code)
+	}
+}
@@ -0,0 +1,109 @@
+package pasteburn
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Redacted replaces the value of any log field that might hold secret material.
+const Redacted = "[REDACTED]"
+
+// sensitiveFields are substrings of log field names whose values are always redacted.
+var sensitiveFields = []string{
+	"key",
+	"passphrase",
+	"password",
+	"secret",
+	"token",
+	"body",
+	"contents",
+	"plaintext",
+}
+
+// fingerprintSecret keys KeyFingerprint. It's generated once per process, so
+// fingerprints can correlate log lines without letting anyone who reads the
+// logs test guesses against them offline.
+var fingerprintSecret = func() []byte {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return b
+}()
+
+// KeyFingerprint returns a short identifier for a key that is safe to log.
+func KeyFingerprint(key []byte) string {
+	mac := hmac.New(sha256.New, fingerprintSecret)
+	mac.Write(key)
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// RedactFields returns a copy of fields that's safe to log. Values of fields
+// whose names look sensitive are replaced with Redacted and raw bytes are
+// replaced with their length. A field named "keyFingerprint" is kept, since
+// KeyFingerprint is the one sanctioned way to refer to a key.
+func RedactFields(fields log.Fields) log.Fields {
+	out := make(log.Fields, len(fields))
+	for name, v := range fields {
+		out[name] = redactField(name, v)
+	}
+	return out
+}
+
+func redactField(name string, v interface{}) interface{} {
+	if name == "keyFingerprint" {
+		return v
+	}
+
+	lower := strings.ToLower(name)
+	for _, s := range sensitiveFields {
+		if strings.Contains(lower, s) {
+			return Redacted
+		}
+	}
+
+	switch b := v.(type) {
+	case []byte:
+		return fmt.Sprintf("[%d bytes]", len(b))
+	case [32]byte:
+		return Redacted
+	}
+
+	return v
+}
+
+// RedactHook is a logrus hook that redacts every entry's fields before it's
+// formatted. Add it to loggers that code outside this package also writes to.
+type RedactHook struct{}
+
+// Levels implements log.Hook.
+func (RedactHook) Levels() []log.Level {
+	return log.AllLevels
+}
+
+// Fire implements log.Hook.
+func (RedactHook) Fire(e *log.Entry) error {
+	for name, v := range e.Data {
+		e.Data[name] = redactField(name, v)
+	}
+	return nil
+}
+
+// redactingLogger wraps a FieldLogger so fields attached through it are redacted.
+type redactingLogger struct {
+	log.FieldLogger
+}
+
+func (l redactingLogger) WithField(name string, value interface{}) *log.Entry {
+	return l.FieldLogger.WithField(name, redactField(name, value))
+}
+
+func (l redactingLogger) WithFields(fields log.Fields) *log.Entry {
+	return l.FieldLogger.WithFields(RedactFields(fields))
+}
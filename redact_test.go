@@ -0,0 +1,123 @@
+package pasteburn
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// Runs the service through its logging paths with planted secrets and checks
+// that none of them show up in the captured output.
+func TestLogsContainNoSecrets(t *testing.T) {
+	defer cheapKDFPolicy(KDFArgon2id)()
+
+	dir, err := ioutil.TempDir("", "pasteburn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBoltBackedService(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	var out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	logger.Level = log.DebugLevel
+	logger.Formatter = &log.JSONFormatter{}
+	s.Logger = logger
+
+	ctx := context.Background()
+
+	const (
+		plantedBody       = "PLANTED-BODY-0f1e2d"
+		plantedPassphrase = "PLANTED-PASSPHRASE-3c4b5a"
+		plantedWrongKey   = "PLANTED-WRONG-KEY-6978a7"
+	)
+
+	d, err := NewDocumentWithPassphrase([]byte(plantedBody), []byte(plantedPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostDocument(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetDocument(ctx, d.ID, []byte(plantedWrongKey)); err != ErrDecrypt {
+		t.Fatalf("Expected ErrDecrypt, got %v", err)
+	}
+
+	d, err = NewDocumentWithPassphrase([]byte(plantedBody), []byte(plantedPassphrase))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Reads = 2
+	if err := s.PostDocument(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetDocument(ctx, d.ID, []byte(plantedPassphrase)); err != nil {
+		t.Fatal(err)
+	}
+
+	md, _, err := NewMultiDoc([]byte(plantedBody), nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostMultiDoc(ctx, md); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetMultiDoc(ctx, md.ID, append([]byte{0}, plantedWrongKey...)); err == nil {
+		t.Fatal("Expected an error for a wrong multidoc key")
+	}
+
+	// Fields logged directly through the service's logger are redacted too.
+	s.logger().WithFields(log.Fields{
+		"key":      plantedPassphrase,
+		"body":     []byte(plantedBody),
+		"raw":      []byte(plantedWrongKey),
+		"keyHash":  [32]byte{},
+		"document": "fine",
+	}).Info("planted")
+	s.logger().WithField("passphrase", plantedPassphrase).Info("planted")
+
+	logged := out.String()
+	if !strings.Contains(logged, "keyFingerprint") {
+		t.Fatal("Expected decryption failures to be logged with a key fingerprint")
+	}
+	for _, secret := range []string{plantedBody, plantedPassphrase, plantedWrongKey} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("Log output contains planted secret %q:\n%s", secret, logged)
+		}
+	}
+}
+
+func TestRedactHook(t *testing.T) {
+	var out bytes.Buffer
+	logger := log.New()
+	logger.Out = &out
+	logger.Hooks.Add(RedactHook{})
+
+	logger.WithField("key", "PLANTED-KEY-f00d").Info("planted")
+
+	if strings.Contains(out.String(), "PLANTED-KEY-f00d") {
+		t.Errorf("Hook let a key through: %s", out.String())
+	}
+}
+
+func TestKeyFingerprint(t *testing.T) {
+	a := KeyFingerprint([]byte("a"))
+	if a != KeyFingerprint([]byte("a")) {
+		t.Error("Fingerprints of the same key differ")
+	}
+	if a == KeyFingerprint([]byte("b")) {
+		t.Error("Fingerprints of different keys match")
+	}
+}
@@ -0,0 +1,270 @@
+package pasteburn
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3ObjectStore is an ObjectStore for S3 and compatible services such as
+// MinIO. Requests use path-style URLs and are signed with AWS Signature
+// Version 4. Conditional writes and deletes rely on If-Match support, which
+// AWS S3 and recent MinIO releases have.
+type S3ObjectStore struct {
+	// Endpoint is the service URL, e.g. "https://s3.us-east-1.amazonaws.com".
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	AccessKeyID     string
+	SecretAccessKey string
+
+	// Client defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+// GetObject implements ObjectStore.
+func (s *S3ObjectStore) GetObject(key string) ([]byte, string, error) {
+	res, err := s.do("GET", key, nil, nil, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return data, res.Header.Get("ETag"), nil
+}
+
+// PutObject implements ObjectStore.
+func (s *S3ObjectStore) PutObject(key string, data []byte, ifMatch string) error {
+	res, err := s.do("PUT", key, nil, conditionHeader(ifMatch), data)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// DeleteObject implements ObjectStore.
+func (s *S3ObjectStore) DeleteObject(key string, ifMatch string) error {
+	res, err := s.do("DELETE", key, nil, conditionHeader(ifMatch), nil)
+	if err == ErrObjectNotFound && ifMatch == "" {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// ListObjects implements ObjectStore, following continuation tokens until
+// the listing is complete.
+func (s *S3ObjectStore) ListObjects(prefix string) ([]ObjectInfo, error) {
+	var (
+		infos []ObjectInfo
+		token string
+	)
+
+	for {
+		query := url.Values{
+			"list-type": {"2"},
+			"prefix":    {prefix},
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		res, err := s.do("GET", "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var page struct {
+			Contents []struct {
+				Key          string
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		err = xml.NewDecoder(res.Body).Decode(&page)
+		res.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range page.Contents {
+			infos = append(infos, ObjectInfo{Key: c.Key, LastModified: c.LastModified})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return infos, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func conditionHeader(ifMatch string) http.Header {
+	if ifMatch == "" {
+		return nil
+	}
+	return http.Header{"If-Match": {ifMatch}}
+}
+
+// do sends a signed request for key, or for the bucket itself if key is
+// empty, and maps error statuses to ObjectStore errors.
+func (s *S3ObjectStore) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + s.Bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = awsQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, v := range header {
+		req.Header[name] = v
+	}
+
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]), time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 == 2 {
+		return res, nil
+	}
+
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		return nil, ErrObjectNotFound
+	case http.StatusPreconditionFailed, http.StatusConflict:
+		// S3 answers 409 when a concurrent conditional write won the race.
+		return nil, ErrPreconditionFailed
+	}
+	return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, res.Status, msg)
+}
+
+// sign adds AWS Signature Version 4 headers to req, signing every header it
+// already has along with Host.
+func (s *S3ObjectStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	scope := amzDate[:8] + "/" + s.Region + "/s3/aws4_request"
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, v := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	key := []byte("AWS4" + s.SecretAccessKey)
+	for _, part := range []string{amzDate[:8], s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsQuery encodes query the way Signature Version 4 requires: sorted by key
+// and with only unreserved characters left unescaped.
+func awsQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string{}, query[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, awsEscape(k)+"="+awsEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func awsEscape(s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
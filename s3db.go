@@ -0,0 +1,754 @@
+package pasteburn
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// S3DBService implements DatabaseService on an ObjectStore, so several
+// stateless replicas can share one bucket. Objects are laid out as:
+//
+//	documents/<key>          a document or blob, under its ID or blobKey
+//	multidocs/<id>/<idx>     one copy of a MultiDoc
+//	multidocs/<id>/shared    the body its copies' keys decrypt, if it has one
+//	streams/<id>             a stream's manifest
+//	chunks/<id>/<seq>        a stream's contents, in s3ChunkSize pieces
+//	tombstones/<key>         why a record is gone, as in BoltDBService
+//	statuses/<key>           a MultiDoc's status, if it has one, under its
+//	                         multiDocStatusKey, and each copy's under its
+//	                         multiDocReadsKey
+//	expiry/<deadline>/<kind>/<key>
+//	                         an empty object per deadline, as in BoltDBService's index
+//
+// Keys are hex encoded and deadlines are 16 hex digits of Unix nanoseconds, so
+// listing expiry/ walks deadlines in order. Records start with their read
+// count and deadline, so every read is a conditional get-then-write: the
+// counter is decremented with a PUT, and the last read is a DELETE, both
+// conditional on the ETag that was read. Whichever replica's write lands first
+// wins; the others see the precondition fail and start over, so each read is
+// handed out exactly once.
+//
+// Burned streams' chunks can't be deleted right away, since another replica
+// may still be streaming them. They're swept once their tombstone is older
+// than orphanTTL, and chunks of uploads that never wrote a manifest once
+// they've been idle that long.
+type S3DBService struct {
+	store ObjectStore
+}
+
+// s3ChunkSize is the size of every stored stream chunk except the last.
+const s3ChunkSize = 8 << 20
+
+// NewS3DBService returns an S3DBService storing everything in store.
+func NewS3DBService(store ObjectStore) *S3DBService {
+	return &S3DBService{store: store}
+}
+
+// Close implements DatabaseService. There's nothing to release.
+func (s *S3DBService) Close() error {
+	return nil
+}
+
+// s3Record is the header every document, MultiDoc copy and stream manifest
+// object starts with: a 4 byte read count and an 8 byte deadline, zero if none.
+type s3Record struct {
+	reads    int
+	expires  time.Time
+	contents []byte
+}
+
+func (r s3Record) marshal() []byte {
+	b := make([]byte, 12, 12+len(r.contents))
+	binary.BigEndian.PutUint32(b, uint32(maxInt(r.reads, 1)))
+	if !r.expires.IsZero() {
+		binary.BigEndian.PutUint64(b[4:], uint64(r.expires.UnixNano()))
+	}
+	return append(b, r.contents...)
+}
+
+func parseS3Record(b []byte) (s3Record, error) {
+	if len(b) < 12 {
+		return s3Record{}, errors.New("malformed record")
+	}
+	r := s3Record{
+		reads:    int(binary.BigEndian.Uint32(b)),
+		contents: b[12:],
+	}
+	if ns := int64(binary.BigEndian.Uint64(b[4:])); ns != 0 {
+		r.expires = time.Unix(0, ns)
+	}
+	return r, nil
+}
+
+func s3Key(elem ...string) string {
+	return strings.Join(elem, "/")
+}
+
+func s3Seq(seq uint64) string {
+	return fmt.Sprintf("%016x", seq)
+}
+
+// SaveDocument saves a document.
+func (s *S3DBService) SaveDocument(d *Document) error {
+	return s.saveDocument(d, hex.EncodeToString(d.ID[:]))
+}
+
+// SaveBlob saves a blob.
+func (s *S3DBService) SaveBlob(d *Document) error {
+	return s.saveDocument(d, hex.EncodeToString(blobKey(d.ID)))
+}
+
+func (s *S3DBService) saveDocument(d *Document, key string) error {
+	if err := s.putExpiry(key, d.Expires, expiryKindDocument); err != nil {
+		return err
+	}
+
+	return s.store.PutObject(s3Key("documents", key), s3Record{
+		reads:    d.Reads,
+		expires:  d.Expires,
+		contents: d.Contents,
+	}.marshal(), "")
+}
+
+// LoadDocument consumes one read of the document stored under id.
+func (s *S3DBService) LoadDocument(id uuid.UUID) (*Document, error) {
+	return s.loadDocument(id, hex.EncodeToString(id[:]))
+}
+
+// LoadBlob consumes one read of the blob stored under id.
+func (s *S3DBService) LoadBlob(id uuid.UUID) (*Document, error) {
+	return s.loadDocument(id, hex.EncodeToString(blobKey(id)))
+}
+
+func (s *S3DBService) loadDocument(id uuid.UUID, key string) (*Document, error) {
+	contents, _, err := s.consume(s3Key("documents", key), key, expiryKindDocument, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Document{
+		ID:       id,
+		Contents: contents,
+	}, nil
+}
+
+// SaveMultiDoc saves a MultiDoc, one object per copy and one for its body.
+func (s *S3DBService) SaveMultiDoc(md *MultiDoc) error {
+	key := hex.EncodeToString(md.ID[:])
+	if err := s.putExpiry(key, md.Expires, expiryKindMultiDoc); err != nil {
+		return err
+	}
+
+	if md.Body != nil {
+		if err := s.store.PutObject(s3Key("multidocs", key, multiDocBodyName), md.Body, ""); err != nil {
+			return err
+		}
+	}
+	for idx, d := range md.Documents {
+		if err := s.store.PutObject(s3Key("multidocs", key, hex.EncodeToString(multiDocIndex(idx))), s3Record{
+			reads:    md.Reads,
+			expires:  md.Expires,
+			contents: d.Contents,
+		}.marshal(), ""); err != nil {
+			return err
+		}
+	}
+
+	st, err := newMultiDocStatus(md)
+	if err != nil {
+		return err
+	}
+	if st == nil {
+		return nil
+	}
+	for idx, c := range st.Copies {
+		v, err := c.marshal()
+		if err != nil {
+			return err
+		}
+		if err := s.store.PutObject(s3Key("statuses", hex.EncodeToString(multiDocReadsKey(md.ID, idx))), v, ""); err != nil {
+			return err
+		}
+	}
+	v, err := st.marshal()
+	if err != nil {
+		return err
+	}
+	return s.store.PutObject(s3Key("statuses", s3StatusKey(key)), v, "")
+}
+
+// LoadMultiDoc consumes one read of the copy at idx of the MultiDoc stored
+// under id. The body is fetched first, since burning the last copy deletes it.
+func (s *S3DBService) LoadMultiDoc(id uuid.UUID, idx uint32) (*Document, []byte, error) {
+	key := hex.EncodeToString(id[:])
+	copyKey := hex.EncodeToString(multiDocReadsKey(id, idx))
+
+	body, _, err := s.store.GetObject(s3Key("multidocs", key, multiDocBodyName))
+	if err != nil && err != ErrObjectNotFound {
+		return nil, nil, err
+	}
+
+	contents, burned, err := s.consume(s3Key("multidocs", key, hex.EncodeToString(multiDocIndex(idx))), copyKey, expiryKindMultiDoc, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := s.recordRead(copyKey, burned, time.Now()); err != nil {
+		return nil, nil, err
+	}
+
+	return &Document{
+		ID:       id,
+		Contents: contents,
+	}, body, nil
+}
+
+// PeekMultiDoc returns the copy at idx of the MultiDoc stored under id and
+// its Body without consuming a read.
+func (s *S3DBService) PeekMultiDoc(id uuid.UUID, idx uint32) (*Document, []byte, error) {
+	key := hex.EncodeToString(id[:])
+	copyKey := hex.EncodeToString(multiDocReadsKey(id, idx))
+
+	data, _, err := s.store.GetObject(s3Key("multidocs", key, hex.EncodeToString(multiDocIndex(idx))))
+	if err == ErrObjectNotFound {
+		return nil, nil, s.tombstoneErr(copyKey, key)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	r, err := parseS3Record(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	if expiredAt(r.expires, time.Now()) {
+		return nil, nil, ErrExpired
+	}
+
+	body, _, err := s.store.GetObject(s3Key("multidocs", key, multiDocBodyName))
+	if err != nil && err != ErrObjectNotFound {
+		return nil, nil, err
+	}
+
+	return &Document{
+		ID:       id,
+		Contents: r.contents,
+	}, body, nil
+}
+
+// SaveStream stores everything read from r as chunks, then writes the
+// manifest that makes the stream readable. If anything fails first, the
+// chunks written so far are deleted.
+func (s *S3DBService) SaveStream(d *Document, r io.Reader) error {
+	key := hex.EncodeToString(d.ID[:])
+
+	var (
+		m   streamManifest
+		buf = make([]byte, s3ChunkSize)
+	)
+	err := func() error {
+		for {
+			n, err := io.ReadFull(r, buf)
+			if n > 0 {
+				if err := s.store.PutObject(s3Key("chunks", key, s3Seq(m.Chunks)), buf[:n], ""); err != nil {
+					return err
+				}
+				m.Size += uint64(n)
+				m.Chunks++
+			}
+			switch err {
+			case nil:
+			case io.EOF, io.ErrUnexpectedEOF:
+				return nil
+			default:
+				return err
+			}
+		}
+	}()
+	if err == nil {
+		err = s.putExpiry(key, d.Expires, expiryKindStream)
+	}
+	if err == nil {
+		err = s.store.PutObject(s3Key("streams", key), s3Record{
+			reads:    d.Reads,
+			expires:  d.Expires,
+			contents: m.marshal(),
+		}.marshal(), "")
+	}
+	if err != nil {
+		s.deleteChunks(key, m.Chunks)
+		return err
+	}
+
+	return nil
+}
+
+// LoadStream consumes one read of the stream stored under id. The returned
+// reader fetches one chunk at a time.
+func (s *S3DBService) LoadStream(id uuid.UUID) (io.ReadCloser, error) {
+	key := hex.EncodeToString(id[:])
+
+	v, _, err := s.consume(s3Key("streams", key), key, expiryKindStream, key)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := parseStreamManifest(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return &s3ChunkReader{
+		store:    s.store,
+		key:      key,
+		manifest: m,
+	}, nil
+}
+
+// consume takes one read of the record at object, retrying whenever another
+// writer changes it between the read and the conditional write, and reports
+// whether that burned it. tombKey is where its tombstone goes; expiry is
+// deleted with expiryKey and kind.
+func (s *S3DBService) consume(object, tombKey string, kind byte, expiryKey string) ([]byte, bool, error) {
+	for {
+		data, etag, err := s.store.GetObject(object)
+		if err == ErrObjectNotFound {
+			if tombKey == expiryKey {
+				return nil, false, s.tombstoneErr(tombKey)
+			}
+			return nil, false, s.tombstoneErr(tombKey, expiryKey)
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		r, err := parseS3Record(data)
+		if err != nil {
+			return nil, false, err
+		}
+
+		now := time.Now()
+		if expiredAt(r.expires, now) {
+			if err := s.expire(kind, expiryKey, r.expires, now); err != nil {
+				return nil, false, err
+			}
+			return nil, false, ErrExpired
+		}
+
+		// The tombstone goes first so that readers who lose the race see
+		// ErrBurned rather than ErrNotFound. It's only consulted once the
+		// record is gone, so writing it for a read that then loses is harmless.
+		burn := r.reads <= 1
+		if burn {
+			if err := s.putTombstone(tombKey, tombstoneBurned, now); err != nil {
+				return nil, false, err
+			}
+			err = s.store.DeleteObject(object, etag)
+		} else {
+			r.reads--
+			err = s.store.PutObject(object, r.marshal(), etag)
+		}
+		if err == ErrPreconditionFailed || err == ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		if burn {
+			if kind == expiryKindMultiDoc {
+				err = s.removeEmptyMultiDoc(expiryKey, r.expires, now)
+			} else {
+				err = s.clearExpiry(expiryKey, r.expires, kind)
+			}
+			if err != nil {
+				return nil, false, err
+			}
+		}
+
+		return r.contents, burn, nil
+	}
+}
+
+// expire deletes an expired record of any kind and everything stored about
+// it, leaving a tombstone. Concurrent calls for the same record are harmless.
+func (s *S3DBService) expire(kind byte, key string, expires time.Time, now time.Time) error {
+	switch kind {
+	case expiryKindDocument:
+		if err := s.store.DeleteObject(s3Key("documents", key), ""); err != nil {
+			return err
+		}
+	case expiryKindStream:
+		if err := s.store.DeleteObject(s3Key("streams", key), ""); err != nil {
+			return err
+		}
+	case expiryKindMultiDoc:
+		copies, err := s.store.ListObjects(s3Key("multidocs", key) + "/")
+		if err != nil {
+			return err
+		}
+		for _, c := range copies {
+			if err := s.store.DeleteObject(c.Key, ""); err != nil {
+				return err
+			}
+		}
+		if err := s.updateStatus(key, func(st *MultiDocStatus) {
+			st.expire(now)
+		}); err != nil {
+			return err
+		}
+	case expiryKindStatus:
+		// Each copy's status shares the MultiDoc's ID as a prefix.
+		objects, err := s.store.ListObjects(s3Key("statuses", key[:hex.EncodedLen(len(uuid.UUID{}))]))
+		if err != nil {
+			return err
+		}
+		for _, o := range objects {
+			if err := s.store.DeleteObject(o.Key, ""); err != nil {
+				return err
+			}
+		}
+		return s.clearExpiry(key, expires, kind)
+	case expiryKindTombstone:
+		if err := s.store.DeleteObject(s3Key("tombstones", key), ""); err != nil {
+			return err
+		}
+		return s.clearExpiry(key, expires, kind)
+	}
+
+	if err := s.putTombstone(key, tombstoneExpired, now); err != nil {
+		return err
+	}
+	return s.clearExpiry(key, expires, kind)
+}
+
+// PurgeExpired deletes every record whose deadline is at or before now,
+// returning how many were removed, then sweeps stale tombstones and orphaned
+// stream chunks.
+func (s *S3DBService) PurgeExpired(now time.Time) (int, error) {
+	entries, err := s.store.ListObjects("expiry/")
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, e := range entries {
+		parts := strings.Split(e.Key, "/")
+		if len(parts) != 4 || len(parts[2]) != 1 {
+			continue
+		}
+		ns, err := strconv.ParseUint(parts[1], 16, 64)
+		if err != nil {
+			continue
+		}
+		deadline := time.Unix(0, int64(ns))
+		if deadline.After(now) {
+			break
+		}
+
+		kind := parts[2][0]
+		if err := s.expire(kind, parts[3], deadline, now); err != nil {
+			return purged, err
+		}
+		if kind != expiryKindTombstone && kind != expiryKindStatus {
+			purged++
+		}
+	}
+
+	return purged, s.purgeOrphanChunks(now)
+}
+
+// purgeOrphanChunks deletes the chunks of streams without a manifest once
+// they've burned or sat idle for longer than orphanTTL.
+func (s *S3DBService) purgeOrphanChunks(now time.Time) error {
+	chunks, err := s.store.ListObjects("chunks/")
+	if err != nil {
+		return err
+	}
+
+	byStream := make(map[string][]ObjectInfo)
+	var keys []string
+	for _, c := range chunks {
+		parts := strings.Split(c.Key, "/")
+		if len(parts) != 3 {
+			continue
+		}
+		if _, ok := byStream[parts[1]]; !ok {
+			keys = append(keys, parts[1])
+		}
+		byStream[parts[1]] = append(byStream[parts[1]], c)
+	}
+
+	for _, key := range keys {
+		if _, _, err := s.store.GetObject(s3Key("streams", key)); err != ErrObjectNotFound {
+			continue
+		}
+
+		idle := now.Sub(latest(byStream[key]))
+		if v, _, err := s.store.GetObject(s3Key("tombstones", key)); err == nil && len(v) == 9 {
+			idle = now.Sub(time.Unix(0, int64(binary.BigEndian.Uint64(v[1:]))))
+		}
+		if idle <= orphanTTL {
+			continue
+		}
+
+		for _, c := range byStream[key] {
+			if err := s.store.DeleteObject(c.Key, ""); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func latest(infos []ObjectInfo) time.Time {
+	var t time.Time
+	for _, i := range infos {
+		if i.LastModified.After(t) {
+			t = i.LastModified
+		}
+	}
+	return t
+}
+
+func (s *S3DBService) deleteChunks(key string, n uint64) {
+	for seq := uint64(0); seq < n; seq++ {
+		s.store.DeleteObject(s3Key("chunks", key, s3Seq(seq)), "")
+	}
+}
+
+func s3ExpiryKey(key string, expires time.Time, kind byte) string {
+	return s3Key("expiry", s3Seq(uint64(expires.UnixNano())), string(kind), key)
+}
+
+func (s *S3DBService) putExpiry(key string, expires time.Time, kind byte) error {
+	if expires.IsZero() {
+		return nil
+	}
+	return s.store.PutObject(s3ExpiryKey(key, expires, kind), nil, "")
+}
+
+func (s *S3DBService) clearExpiry(key string, expires time.Time, kind byte) error {
+	if expires.IsZero() {
+		return nil
+	}
+	return s.store.DeleteObject(s3ExpiryKey(key, expires, kind), "")
+}
+
+// LoadMultiDocStatus returns the status of the MultiDoc stored under id.
+func (s *S3DBService) LoadMultiDocStatus(id uuid.UUID) (*MultiDocStatus, error) {
+	key := hex.EncodeToString(id[:])
+	v, _, err := s.store.GetObject(s3Key("statuses", s3StatusKey(key)))
+	if err == ErrObjectNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	st, err := parseMultiDocStatus(v)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := s3Key("statuses", key)
+	objects, err := s.store.ListObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, o := range objects {
+		b, err := hex.DecodeString(strings.TrimPrefix(o.Key, prefix))
+		if err != nil {
+			continue
+		}
+		idx, ok := parseMultiDocIndex(b)
+		if !ok {
+			continue
+		}
+
+		v, _, err := s.store.GetObject(o.Key)
+		if err == ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if st.Copies[idx], err = parseCopyStatus(v); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
+
+// s3StatusKey is the hex encoded multiDocStatusKey for a MultiDoc's hex encoded key.
+func s3StatusKey(key string) string {
+	return key + hex.EncodeToString([]byte("status"))
+}
+
+// updateStatus applies update to the status of the MultiDoc stored under
+// key, if it has one, retrying like consume when another replica updates it
+// first. Reads don't touch it, only the set finishing or expiring.
+func (s *S3DBService) updateStatus(key string, update func(*MultiDocStatus)) error {
+	statusKey := s3StatusKey(key)
+	object := s3Key("statuses", statusKey)
+
+	for {
+		v, etag, err := s.store.GetObject(object)
+		if err == ErrObjectNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		st, err := parseMultiDocStatus(v)
+		if err != nil {
+			return err
+		}
+
+		finished := !st.Finished.IsZero()
+		update(st)
+
+		if v, err = st.marshal(); err != nil {
+			return err
+		}
+		err = s.store.PutObject(object, v, etag)
+		if err == ErrPreconditionFailed || err == ErrObjectNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if finished || st.Finished.IsZero() {
+			return nil
+		}
+		return s.putExpiry(statusKey, st.Finished.Add(tombstoneTTL), expiryKindStatus)
+	}
+}
+
+// recordRead records a read of the copy whose hex encoded multiDocReadsKey is
+// copyKey in its status, if the MultiDoc has one. Only readers of that one
+// copy contend for the object, retrying like consume. It isn't atomic with
+// the read it records, so a replica that fails in between leaves that read
+// out of the status.
+func (s *S3DBService) recordRead(copyKey string, burned bool, now time.Time) error {
+	object := s3Key("statuses", copyKey)
+
+	for {
+		v, etag, err := s.store.GetObject(object)
+		if err == ErrObjectNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		c, err := parseCopyStatus(v)
+		if err != nil {
+			return err
+		}
+
+		c.read(burned, now)
+
+		if v, err = c.marshal(); err != nil {
+			return err
+		}
+		err = s.store.PutObject(object, v, etag)
+		if err == ErrPreconditionFailed || err == ErrObjectNotFound {
+			continue
+		}
+		return err
+	}
+}
+
+// removeEmptyMultiDoc deletes a MultiDoc's body and expiry entry once its
+// last copy is gone, so the sweeper has nothing left to do for it, and marks
+// its status finished.
+func (s *S3DBService) removeEmptyMultiDoc(key string, expires time.Time, now time.Time) error {
+	body := s3Key("multidocs", key, multiDocBodyName)
+	objects, err := s.store.ListObjects(s3Key("multidocs", key) + "/")
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		if o.Key != body {
+			return nil
+		}
+	}
+
+	if err := s.store.DeleteObject(body, ""); err != nil {
+		return err
+	}
+	if err := s.updateStatus(key, func(st *MultiDocStatus) {
+		st.finish(now)
+	}); err != nil {
+		return err
+	}
+	return s.clearExpiry(key, expires, expiryKindMultiDoc)
+}
+
+func (s *S3DBService) putTombstone(key string, reason byte, now time.Time) error {
+	v := make([]byte, 9)
+	v[0] = reason
+	binary.BigEndian.PutUint64(v[1:], uint64(now.UnixNano()))
+
+	if err := s.putExpiry(key, now.Add(tombstoneTTL), expiryKindTombstone); err != nil {
+		return err
+	}
+	return s.store.PutObject(s3Key("tombstones", key), v, "")
+}
+
+// tombstoneErr is the object store counterpart of BoltDBService.tombstoneErr.
+func (s *S3DBService) tombstoneErr(keys ...string) error {
+	for _, key := range keys {
+		v, _, err := s.store.GetObject(s3Key("tombstones", key))
+		if err != nil || len(v) != 9 {
+			continue
+		}
+		if err := tombstoneReasonErr(v[0]); err != ErrNotFound {
+			return err
+		}
+	}
+	return ErrNotFound
+}
+
+// s3ChunkReader streams a stored stream one chunk at a time.
+type s3ChunkReader struct {
+	store    ObjectStore
+	key      string
+	manifest streamManifest
+	next     uint64
+	chunk    *bytes.Reader
+}
+
+func (r *s3ChunkReader) Read(p []byte) (int, error) {
+	for r.chunk == nil || r.chunk.Len() == 0 {
+		if r.next >= r.manifest.Chunks {
+			return 0, io.EOF
+		}
+
+		data, _, err := r.store.GetObject(s3Key("chunks", r.key, s3Seq(r.next)))
+		if err == ErrObjectNotFound {
+			return 0, errors.New("stream chunk is missing")
+		}
+		if err != nil {
+			return 0, err
+		}
+		r.chunk = bytes.NewReader(data)
+		r.next++
+	}
+
+	return r.chunk.Read(p)
+}
+
+// Close implements io.Closer. Chunks are swept later, so there's nothing to do.
+func (r *s3ChunkReader) Close() error {
+	return nil
+}
@@ -0,0 +1,211 @@
+package pasteburn
+
+import (
+	"crypto/rand"
+	"errors"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+var (
+	// ErrShareKey is returned when a key given to CombineShares isn't a share key.
+	ErrShareKey = errors.New("malformed share key")
+	// ErrNotEnoughShares is returned when fewer shares than the threshold are
+	// offered, or they don't belong to the same split.
+	ErrNotEnoughShares = errors.New("not enough shares to reconstruct the secret")
+)
+
+// gfExp and gfLog are exponent and logarithm tables for GF(256) with the AES
+// polynomial x^8 + x^4 + x^3 + x + 1 and generator 3. gfExp is doubled so
+// products of logs can index it without reducing mod 255.
+var gfExp, gfLog = func() (exp [510]byte, logs [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i] = x
+		exp[i+255] = x
+		logs[x] = byte(i)
+
+		// Multiply by the generator, x+1.
+		hi := x & 0x80
+		x2 := x << 1
+		if hi != 0 {
+			x2 ^= 0x1b
+		}
+		x ^= x2
+	}
+	return
+}()
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// splitSecret splits secret into count shares with Shamir's scheme over
+// GF(256), byte by byte, so that any threshold of them reconstruct it and
+// fewer reveal nothing about it. Share i is the polynomials evaluated at i+1.
+func splitSecret(secret []byte, threshold, count byte) ([][]byte, error) {
+	if threshold < 2 || threshold > count {
+		return nil, errors.New("threshold must be between 2 and the number of shares")
+	}
+
+	coeffs := make([]byte, len(secret)*int(threshold-1))
+	if _, err := rand.Read(coeffs); err != nil {
+		return nil, err
+	}
+
+	shares := make([][]byte, count)
+	for i := range shares {
+		x := byte(i + 1)
+		share := make([]byte, len(secret))
+		for j, s := range secret {
+			// Horner's method, highest coefficient first.
+			c := coeffs[j*int(threshold-1) : (j+1)*int(threshold-1)]
+			var y byte
+			for k := len(c) - 1; k >= 0; k-- {
+				y = gfMul(y, x) ^ c[k]
+			}
+			share[j] = gfMul(y, x) ^ s
+		}
+		shares[i] = share
+	}
+
+	return shares, nil
+}
+
+// combineShares reconstructs a secret from shares keyed by their x coordinate
+// by Lagrange interpolation at zero. Every share must be the same length.
+func combineShares(shares map[byte][]byte) ([]byte, error) {
+	var size int
+	for x, share := range shares {
+		if x == 0 {
+			return nil, ErrShareKey
+		}
+		size = len(share)
+	}
+
+	secret := make([]byte, size)
+	for xi, yi := range shares {
+		if len(yi) != size {
+			return nil, ErrNotEnoughShares
+		}
+
+		// The Lagrange basis polynomial for xi, evaluated at zero. Subtraction
+		// is XOR in GF(256).
+		basis := byte(1)
+		for xj := range shares {
+			if xj != xi {
+				basis = gfMul(basis, gfDiv(xj, xj^xi))
+			}
+		}
+
+		for k := range secret {
+			secret[k] ^= gfMul(yi[k], basis)
+		}
+	}
+
+	return secret, nil
+}
+
+// KDFShamir marks the Body of a NewShamirMultiDoc. Its key is the data key
+// reconstructed from the shares, used as is, and its KDFParams hold the
+// threshold, so the server knows it without trusting the keys it's given.
+const KDFShamir KDF = 4
+
+// MaxShares is the most shares a secret can be split into, since each one
+// needs a distinct nonzero x coordinate in GF(256).
+const MaxShares = 255
+
+// NewShamirMultiDoc returns a MultiDoc whose Body is body encrypted under a
+// generated data key and whose copies are count Shamir shares of that key,
+// any threshold of which reconstruct it with CombineShares. A reconstruction
+// from the wrong shares fails to authenticate the Body rather than yielding
+// garbage. Each share is encrypted under its own generated key. The returned
+// keys are the copy index, then threshold, a byte each, then that key.
+func NewShamirMultiDoc(body []byte, threshold, count byte) (*MultiDoc, [][]byte, error) {
+	if count < 1 {
+		return nil, nil, errors.New("a multidoc needs at least one share")
+	}
+
+	dataKey, err := GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	shares, err := splitSecret(dataKey, threshold, count)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sealed := &Document{
+		ID:       *id,
+		Contents: body,
+	}
+	if err := sealed.seal(dataKey, KDFShamir, []byte{threshold}); err != nil {
+		return nil, nil, err
+	}
+
+	md := &MultiDoc{
+		ID:        *id,
+		Body:      sealed.Contents,
+		Documents: make(map[uint32]*Document),
+	}
+	keys := make([][]byte, count)
+
+	for i, share := range shares {
+		key, err := GenerateKey()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		d, err := NewDocumentWithID(id, share, key)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		md.Documents[uint32(i)] = d
+		keys[i] = append([]byte{byte(i), threshold}, key...)
+	}
+
+	return md, keys, nil
+}
+
+// shamirThreshold returns the threshold stored in the Body of a
+// NewShamirMultiDoc, or ErrShareKey if body isn't one.
+func shamirThreshold(body []byte) (byte, error) {
+	if body == nil {
+		return 0, ErrShareKey
+	}
+
+	e, err := ParseEnvelope(body)
+	if err != nil {
+		return 0, err
+	}
+	if e.KDF != KDFShamir || len(e.KDFParams) != 1 {
+		return 0, ErrShareKey
+	}
+
+	return e.KDFParams[0], nil
+}
+
+// parseShareKey splits a key from NewShamirMultiDoc into its parts.
+func parseShareKey(key []byte) (idx, threshold byte, encKey []byte, err error) {
+	if len(key) != 2+AES256KeySizeBytes {
+		return 0, 0, nil, ErrShareKey
+	}
+	return key[0], key[1], key[2:], nil
+}
@@ -0,0 +1,226 @@
+package pasteburn
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestGFDivInvertsMul(t *testing.T) {
+	for a := 0; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			if got := gfDiv(gfMul(byte(a), byte(b)), byte(b)); got != byte(a) {
+				t.Fatalf("%d * %d / %d = %d", a, b, b, got)
+			}
+		}
+	}
+}
+
+// Every subset of at least threshold shares must reconstruct the secret.
+func TestShamirRoundTrip(t *testing.T) {
+	secret := []byte("the launch codes are 0000")
+	shares, err := splitSecret(secret, 3, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for subset := 0; subset < 1<<5; subset++ {
+		picked := make(map[byte][]byte)
+		for i := range shares {
+			if subset&(1<<uint(i)) != 0 {
+				picked[byte(i+1)] = shares[i]
+			}
+		}
+		if len(picked) < 3 {
+			continue
+		}
+
+		got, err := combineShares(picked)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Errorf("Shares %05b reconstructed %q", subset, got)
+		}
+	}
+
+	if _, err := splitSecret(secret, 1, 5); err == nil {
+		t.Error("Expected an error for a threshold of 1")
+	}
+	if _, err := splitSecret(secret, 6, 5); err == nil {
+		t.Error("Expected an error for a threshold above the share count")
+	}
+}
+
+func TestMultiCombine(t *testing.T) {
+	s := NewDBBackedService(NewMemoryDBService())
+	ctx := context.Background()
+
+	rec := httptest.NewRecorder()
+	MakeMultiTextAddHandler(ctx, s)(rec, httptest.NewRequest("POST", "/api/multi/create",
+		strings.NewReader(`{"Body": "secret", "Count": "3", "Threshold": "2"}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Create returned status %d: %s", rec.Code, rec.Body)
+	}
+
+	var created struct {
+		ID   string   `json:"id"`
+		Keys [][]byte `json:"keys"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	combine := func(keys ...[]byte) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(map[string]interface{}{"ID": created.ID, "Keys": keys})
+		rec := httptest.NewRecorder()
+		MakeMultiCombineHandler(ctx, s)(rec, httptest.NewRequest("POST", "/api/multi/combine", bytes.NewReader(body)))
+		return rec
+	}
+
+	// Too few shares are refused before any of them is burned.
+	if rec := combine(created.Keys[0]); rec.Code != http.StatusBadRequest {
+		t.Errorf("Combining one share returned status %d", rec.Code)
+	}
+
+	rec = combine(created.Keys[0], created.Keys[2])
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Combine returned status %d: %s", rec.Code, rec.Body)
+	}
+	var res struct {
+		Body string `json:"body"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Body != "secret" {
+		t.Errorf("Combined %q, expected %q", res.Body, "secret")
+	}
+
+	if rec := combine(created.Keys[0], created.Keys[1]); rec.Code != http.StatusGone {
+		t.Errorf("Reusing a combined share returned status %d", rec.Code)
+	}
+}
+
+// The threshold comes from the server, so shares whose keys claim a lower one
+// must be refused before any is burned.
+func TestMultiCombineForgedThreshold(t *testing.T) {
+	s := NewDBBackedService(NewMemoryDBService())
+	ctx := context.Background()
+
+	md, keys, err := NewShamirMultiDoc([]byte("secret"), 3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostMultiDoc(ctx, md); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := make([][]byte, 2)
+	for i := range forged {
+		forged[i] = append([]byte{}, keys[i]...)
+		forged[i][1] = 2
+	}
+	if _, err := s.CombineShares(ctx, md.ID, forged); err != ErrNotEnoughShares {
+		t.Errorf("Expected ErrNotEnoughShares for a forged threshold, got %v", err)
+	}
+
+	got, err := s.CombineShares(ctx, md.ID, keys)
+	if err != nil {
+		t.Fatalf("Forged shares burned the real ones: %v", err)
+	}
+	if string(got) != "secret" {
+		t.Errorf("Combined %q, expected %q", got, "secret")
+	}
+}
+
+// Shares that reconstruct the wrong key must fail to open the body rather
+// than return garbage.
+func TestMultiCombineWrongShares(t *testing.T) {
+	s := NewDBBackedService(NewMemoryDBService())
+	ctx := context.Background()
+
+	md, keys, err := NewShamirMultiDoc([]byte("secret"), 2, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bogus, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if md.Documents[1], err = NewDocumentWithID(&md.ID, bogus, keys[1][2:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostMultiDoc(ctx, md); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.CombineShares(ctx, md.ID, keys); err != ErrDecrypt {
+		t.Errorf("Expected ErrDecrypt for the wrong shares, got %v", err)
+	}
+	if _, _, err := s.db.PeekMultiDoc(md.ID, 0); err != nil {
+		t.Errorf("A failed combine burned share 0: %v", err)
+	}
+}
+
+// A wrong key must fail the combine without burning the shares listed before
+// it, which their holders still need.
+func TestMultiCombineWrongKeyBurnsNothing(t *testing.T) {
+	s := NewDBBackedService(NewMemoryDBService())
+	ctx := context.Background()
+
+	md, keys, err := NewShamirMultiDoc([]byte("secret"), 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostMultiDoc(ctx, md); err != nil {
+		t.Fatal(err)
+	}
+
+	wrong := append([]byte{}, keys[2]...)
+	wrong[len(wrong)-1] ^= 1
+	if _, err := s.CombineShares(ctx, md.ID, [][]byte{keys[0], keys[1], wrong}); err != ErrDecrypt {
+		t.Errorf("Expected ErrDecrypt for a wrong last key, got %v", err)
+	}
+
+	got, err := s.CombineShares(ctx, md.ID, [][]byte{keys[0], keys[1]})
+	if err != nil {
+		t.Fatalf("A failed combine burned shares: %v", err)
+	}
+	if string(got) != "secret" {
+		t.Errorf("Combined %q, expected %q", got, "secret")
+	}
+	if _, err := s.CombineShares(ctx, md.ID, [][]byte{keys[0], keys[2]}); err != ErrBurned {
+		t.Errorf("Expected ErrBurned reusing a combined share, got %v", err)
+	}
+}
+
+// A MultiDoc with no copies could never be read, so its body would never be
+// deleted; it must be refused with or without a threshold.
+func TestMultiCreateNoCopies(t *testing.T) {
+	s := NewDBBackedService(NewMemoryDBService())
+	ctx := context.Background()
+
+	for _, req := range []string{
+		`{"Body": "secret", "Count": "0"}`,
+		`{"Body": "secret", "Count": "0", "Threshold": "2"}`,
+	} {
+		rec := httptest.NewRecorder()
+		MakeMultiTextAddHandler(ctx, s)(rec, httptest.NewRequest("POST", "/api/multi/create", strings.NewReader(req)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("Create %s returned status %d, expected 400", req, rec.Code)
+		}
+	}
+
+	if _, _, err := NewMultiDoc([]byte("secret"), nil, 0); err == nil {
+		t.Error("Expected an error from NewMultiDoc with no copies")
+	}
+	if _, _, err := NewShamirMultiDoc([]byte("secret"), 2, 0); err == nil {
+		t.Error("Expected an error from NewShamirMultiDoc with no shares")
+	}
+}
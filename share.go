@@ -0,0 +1,85 @@
+package pasteburn
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// ShareBaseURL is the public URL share links are built on, e.g. "https://paste.example.com".
+// If empty, it's inferred from the incoming request.
+var ShareBaseURL string
+
+// ShareURL returns a link to the document with the given id at path on base
+// that works when opened as is. The key is carried base64url-encoded in the
+// "k" query parameter, since the view endpoints must receive it and browsers
+// never send the fragment. Links without a key have no "k".
+func ShareURL(base string, path string, id uuid.UUID, key []byte) string {
+	u, err := url.Parse(base)
+	if err != nil {
+		u = &url.URL{}
+	}
+
+	query := url.Values{"id": {id.String()}}
+	if len(key) > 0 {
+		query.Set("k", EncodeShareKey(key))
+	}
+	u.Path = path
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// EncodeShareKey encodes a raw key for use in URLs.
+func EncodeShareKey(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// DecodeShareKey reverses EncodeShareKey.
+func DecodeShareKey(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
+
+// requestKey returns the key for a view request. A share link key in "k"
+// takes precedence over a passphrase in "key". A request with neither gets
+// ErrMissingKey, since loading the document would burn it for nothing.
+func requestKey(query url.Values) ([]byte, error) {
+	if k := query.Get("k"); k != "" {
+		return DecodeShareKey(k)
+	}
+	if key := query.Get("key"); key != "" {
+		return []byte(key), nil
+	}
+	return nil, ErrMissingKey
+}
+
+// shareBase returns ShareBaseURL, falling back to the scheme and host of r.
+func shareBase(r *http.Request) string {
+	if ShareBaseURL != "" {
+		return ShareBaseURL
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host
+}
+
+// writeShareLink responds with everything a client needs to share a document
+// whose key was generated by the server.
+func writeShareLink(w http.ResponseWriter, r *http.Request, path string, id uuid.UUID, key []byte) {
+	json.NewEncoder(w).Encode(&struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+		URL string `json:"url"`
+	}{
+		ID:  id.String(),
+		Key: EncodeShareKey(key),
+		URL: ShareURL(shareBase(r), path, id, key),
+	})
+}
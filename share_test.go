@@ -0,0 +1,133 @@
+package pasteburn
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestShareURLRoundTrip(t *testing.T) {
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDocument([]byte("secret"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(ShareURL("https://paste.example.com", "/api/text/view", d.ID, key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("id") != d.ID.String() {
+		t.Errorf("Share URL %s doesn't carry the document ID", u)
+	}
+
+	got, err := requestKey(u.Query())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, key) {
+		t.Error("Key from share URL doesn't match the generated key")
+	}
+}
+
+// A document created with GenerateKey must be viewable with nothing but the returned link.
+func TestGenerateKeyCreate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pasteburn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := NewBoltBackedService(filepath.Join(dir, "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("POST", "/api/text/create", bytes.NewBufferString(`{"Body":"secret","GenerateKey":true}`))
+	MakeTextAddHandler(ctx, s)(rec, req)
+
+	var res struct {
+		ID  string `json:"id"`
+		Key string `json:"key"`
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(res.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Query().Get("k") != res.Key {
+		t.Errorf("Share URL %s doesn't carry the key", res.URL)
+	}
+
+	// The link must work exactly as returned, as it would opened in a browser.
+	rec = httptest.NewRecorder()
+	MakeTextViewHandler(ctx, s)(rec, httptest.NewRequest("GET", res.URL, nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("View returned status %d: %s", rec.Code, rec.Body)
+	}
+	var view struct {
+		Body string `json:"body"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &view); err != nil {
+		t.Fatal(err)
+	}
+	if view.Body != "secret" {
+		t.Errorf("Viewed body %q, expected %q", view.Body, "secret")
+	}
+}
+
+// A view without a key must be refused before the document is loaded, or it
+// would burn the document for whoever has the key.
+func TestViewWithoutKey(t *testing.T) {
+	s := NewDBBackedService(NewMemoryDBService())
+	ctx := context.Background()
+
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := NewDocument([]byte("secret"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostDocument(ctx, d); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, view := range map[string]http.HandlerFunc{
+		"text":  MakeTextViewHandler(ctx, s),
+		"image": MakeImageViewHandler(ctx, s),
+		"file":  MakeFileViewHandler(ctx, s),
+	} {
+		for _, query := range []string{"", "&k=", "&key="} {
+			rec := httptest.NewRecorder()
+			view(rec, httptest.NewRequest("GET", "/api/view?id="+d.ID.String()+query, nil))
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("%s view with %q returned status %d", name, query, rec.Code)
+			}
+		}
+	}
+
+	if _, err := s.GetDocument(ctx, d.ID, key); err != nil {
+		t.Errorf("Document was burned by views without a key: %v", err)
+	}
+}
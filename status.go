@@ -0,0 +1,210 @@
+package pasteburn
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"io"
+	"time"
+
+	uuid "github.com/nu7hatch/gouuid"
+	"golang.org/x/crypto/hkdf"
+)
+
+// CopyStatus is what a MultiDoc's creator can learn about one of its copies.
+// Each copy's status is stored on its own, so reading a copy only rewrites
+// that copy's status. Label is stored sealed in SealedLabel under a key
+// derived from the status token, and is only set once the token is checked.
+type CopyStatus struct {
+	Label       string `json:"-"`
+	SealedLabel []byte
+	Reads       int
+	LastRead    time.Time
+	Burned      bool
+}
+
+// MultiDocStatus tracks how a MultiDoc's copies have been read, for whoever
+// holds the status token it was created with. It never includes contents or
+// keys. Token is the SHA-256 of the status token. Finished is when the last
+// copy was burned or the set expired; the status is kept for tombstoneTTL
+// after that so the creator can still see how it ended. Copies is stored
+// apart from the rest and gathered when the status is loaded.
+type MultiDocStatus struct {
+	Token    []byte
+	Copies   map[uint32]*CopyStatus `json:"-"`
+	Expires  time.Time
+	Expired  bool
+	Finished time.Time
+}
+
+// statusLabelInfo separates the label key from any other use of the token.
+var statusLabelInfo = []byte("pasteburn status labels")
+
+// NewStatusToken generates the secret md's creator presents to see its
+// status. Only its hash is kept in md, along with the key md's Labels are
+// sealed under when it's saved.
+func (md *MultiDoc) NewStatusToken() ([]byte, error) {
+	token, err := GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	md.labelKey, err = statusLabelKey(token)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(token)
+	md.StatusToken = sum[:]
+
+	return token, nil
+}
+
+// statusLabelKey derives the key a status's labels are sealed under from its
+// token, so the server can't read them without it.
+func statusLabelKey(token []byte) ([]byte, error) {
+	key := make([]byte, AES256KeySizeBytes)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, token, nil, statusLabelInfo), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newMultiDocStatus returns the initial status of md with its labels sealed,
+// or nil if md has no status token.
+func newMultiDocStatus(md *MultiDoc) (*MultiDocStatus, error) {
+	if len(md.StatusToken) == 0 {
+		return nil, nil
+	}
+
+	st := &MultiDocStatus{
+		Token:   md.StatusToken,
+		Copies:  make(map[uint32]*CopyStatus),
+		Expires: md.Expires,
+	}
+	for idx := range md.Documents {
+		c := &CopyStatus{}
+		if label := md.Labels[idx]; label != "" {
+			sealed, err := sealLabel(md.labelKey, md.ID, idx, label)
+			if err != nil {
+				return nil, err
+			}
+			c.SealedLabel = sealed
+		}
+		st.Copies[idx] = c
+	}
+	return st, nil
+}
+
+// sealLabel encrypts the label of the copy at idx, binding it to that copy.
+func sealLabel(key []byte, id uuid.UUID, idx uint32, label string) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, []byte(label), multiDocReadsKey(id, idx)), nil
+}
+
+// openLabels decrypts the labels of the status of the MultiDoc stored under
+// id with the key derived from token.
+func (st *MultiDocStatus) openLabels(id uuid.UUID, token []byte) error {
+	key, err := statusLabelKey(token)
+	if err != nil {
+		return err
+	}
+	aead, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+
+	for idx, c := range st.Copies {
+		if len(c.SealedLabel) == 0 {
+			continue
+		}
+		if len(c.SealedLabel) < aead.NonceSize() {
+			return ErrDecrypt
+		}
+
+		nonce := c.SealedLabel[:aead.NonceSize()]
+		label, err := aead.Open(nil, nonce, c.SealedLabel[aead.NonceSize():], multiDocReadsKey(id, idx))
+		if err != nil {
+			return ErrDecrypt
+		}
+		c.Label = string(label)
+	}
+	return nil
+}
+
+// authorize reports whether token is the status token st was created with.
+func (st *MultiDocStatus) authorize(token []byte) bool {
+	sum := sha256.Sum256(token)
+	return subtle.ConstantTimeCompare(sum[:], st.Token) == 1
+}
+
+// read records a read of the copy, which burned it if burned.
+func (c *CopyStatus) read(burned bool, now time.Time) {
+	c.Reads++
+	c.LastRead = now
+	c.Burned = c.Burned || burned
+}
+
+// finish records that the last copy was burned at now.
+func (st *MultiDocStatus) finish(now time.Time) {
+	if st.Finished.IsZero() {
+		st.Finished = now
+	}
+}
+
+// expire records that the whole set expired.
+func (st *MultiDocStatus) expire(now time.Time) {
+	st.Expired = true
+	st.Finished = now
+}
+
+// stale reports whether st has been kept long enough after finishing.
+func (st *MultiDocStatus) stale(now time.Time) bool {
+	return !st.Finished.IsZero() && !st.Finished.Add(tombstoneTTL).After(now)
+}
+
+func (st *MultiDocStatus) marshal() ([]byte, error) {
+	return json.Marshal(st)
+}
+
+func parseMultiDocStatus(b []byte) (*MultiDocStatus, error) {
+	st := &MultiDocStatus{
+		Copies: make(map[uint32]*CopyStatus),
+	}
+	if err := json.Unmarshal(b, st); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+func (c *CopyStatus) marshal() ([]byte, error) {
+	return json.Marshal(c)
+}
+
+func parseCopyStatus(b []byte) (*CopyStatus, error) {
+	c := &CopyStatus{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// multiDocStatusKey is the key the status of the MultiDoc stored under key is
+// kept and expires under. It can't collide with a Document ID or a
+// multiDocReadsKey, which is what each copy's status is kept under.
+func multiDocStatusKey(key []byte) []byte {
+	return append(append([]byte{}, key...), "status"...)
+}
+
+// expiryKindStatus marks expiry index entries for finished MultiDoc statuses.
+const expiryKindStatus byte = 'c'
@@ -0,0 +1,149 @@
+package pasteburn
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+// The status endpoint shows who has read their copy, but never contents or
+// keys, and only to the creator.
+func TestMultiStatus(t *testing.T) {
+	db := NewMemoryDBService()
+	s := NewDBBackedService(db)
+	ctx := context.Background()
+
+	rec := httptest.NewRecorder()
+	MakeMultiTextAddHandler(ctx, s)(rec, httptest.NewRequest("POST", "/api/multi/create",
+		strings.NewReader(`{"Body": "secret", "Count": "2", "Labels": ["alice", "oncall"]}`)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Create returned status %d: %s", rec.Code, rec.Body)
+	}
+
+	var created struct {
+		ID          string   `json:"id"`
+		Keys        [][]byte `json:"keys"`
+		StatusToken string   `json:"statusToken"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, copies := range db.copyStatuses {
+		for idx, v := range copies {
+			if bytes.Contains(v, []byte("alice")) || bytes.Contains(v, []byte("oncall")) {
+				t.Errorf("Status of copy %d stores its label in plaintext", idx)
+			}
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	MakeMultiTextViewHandler(ctx, s)(rec, httptest.NewRequest("GET", "/api/multi/view?"+url.Values{
+		"id":  {created.ID},
+		"key": {base64.StdEncoding.EncodeToString(created.Keys[0])},
+	}.Encode(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("View returned status %d: %s", rec.Code, rec.Body)
+	}
+
+	status := func(token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		MakeMultiStatusHandler(ctx, s)(rec, httptest.NewRequest("GET", "/api/multi/status?"+url.Values{
+			"id":    {created.ID},
+			"token": {token},
+		}.Encode(), nil))
+		return rec
+	}
+
+	if rec := status(EncodeShareKey(created.Keys[0])); rec.Code != http.StatusForbidden {
+		t.Errorf("Status with a copy key returned status %d", rec.Code)
+	}
+
+	rec = status(created.StatusToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Status returned status %d: %s", rec.Code, rec.Body)
+	}
+	if bytes.Contains(rec.Body.Bytes(), []byte("secret")) {
+		t.Error("Status leaked the contents")
+	}
+	for _, key := range created.Keys {
+		if bytes.Contains(rec.Body.Bytes(), []byte(base64.StdEncoding.EncodeToString(key[1:]))) {
+			t.Error("Status leaked a key")
+		}
+	}
+
+	var res struct {
+		Copies []struct {
+			Index    int     `json:"index"`
+			Label    string  `json:"label"`
+			Reads    int     `json:"reads"`
+			LastRead *string `json:"lastRead"`
+			Burned   bool    `json:"burned"`
+		} `json:"copies"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Copies) != 2 {
+		t.Fatalf("Status lists %d copies, expected 2", len(res.Copies))
+	}
+	alice, oncall := res.Copies[0], res.Copies[1]
+	if alice.Label != "alice" || alice.Reads != 1 || !alice.Burned || alice.LastRead == nil {
+		t.Errorf("alice's copy has status %+v", alice)
+	}
+	if oncall.Label != "oncall" || oncall.Reads != 0 || oncall.Burned || oncall.LastRead != nil {
+		t.Errorf("oncall's copy has status %+v", oncall)
+	}
+}
+
+// Reading a copy must only rewrite that copy's status, however many copies
+// the set has, and the status must still list every copy.
+func TestMultiStatusPerCopy(t *testing.T) {
+	db := NewMemoryDBService()
+	s := NewDBBackedService(db)
+	ctx := context.Background()
+
+	md, keys, err := NewMultiDoc([]byte("secret"), nil, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := md.NewStatusToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PostMultiDoc(ctx, md); err != nil {
+		t.Fatal(err)
+	}
+
+	key := string(md.ID[:])
+	before := append([]byte{}, db.statuses[key]...)
+	others := db.copyStatuses[key][1]
+
+	if _, err := s.GetMultiDoc(ctx, md.ID, keys[299]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(db.statuses[key], before) || !bytes.Equal(db.copyStatuses[key][1], others) {
+		t.Error("Reading copy 299 rewrote more than its own status")
+	}
+
+	st, err := s.GetMultiDocStatus(ctx, md.ID, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st.Copies) != 300 {
+		t.Fatalf("Status lists %d copies, expected 300", len(st.Copies))
+	}
+	if c := st.Copies[299]; c.Reads != 1 || !c.Burned {
+		t.Errorf("Status of the read copy is %+v", c)
+	}
+	if c := st.Copies[1]; c.Reads != 0 || c.Burned {
+		t.Errorf("Status of an unread copy is %+v", c)
+	}
+}
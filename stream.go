@@ -0,0 +1,306 @@
+package pasteburn
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+// StreamSegmentSize is the plaintext size of every segment of an
+// AlgAES256GCMStream envelope except the last, which may be shorter.
+//
+// The ciphertext of a stream is the concatenation of its segments, each sealed
+// separately with AES256-GCM in the STREAM construction: segment i uses the
+// 12 byte nonce prefix||i||last, where prefix is the envelope's 7 byte nonce,
+// i is a 4 byte big endian counter and last is 1 for the final segment and 0
+// otherwise. Every segment is authenticated with the same associated data as a
+// whole-document envelope. Reordering, dropping or truncating segments changes
+// a nonce and so fails authentication, and the final flag means a stream cut
+// at a segment boundary is detected too.
+const StreamSegmentSize = 64 * 1024
+
+// streamNoncePrefixSize is the random part of each segment nonce.
+const streamNoncePrefixSize = 7
+
+// maxStreamSegments is the most segments a stream can have before its counter wraps.
+const maxStreamSegments = 1<<32 - 1
+
+// ErrStreamTooLong is returned when a stream would need more segments than its counter allows.
+var ErrStreamTooLong = errors.New("stream is too long to encrypt")
+
+// streamCipher holds what's shared by the encrypting and decrypting ends of a stream.
+type streamCipher struct {
+	aead    cipher.AEAD
+	prefix  []byte
+	ad      []byte
+	counter uint64
+}
+
+func (c *streamCipher) nonce(last bool) ([]byte, error) {
+	if c.counter >= maxStreamSegments {
+		return nil, ErrStreamTooLong
+	}
+
+	n := make([]byte, c.aead.NonceSize())
+	copy(n, c.prefix)
+	binary.BigEndian.PutUint32(n[streamNoncePrefixSize:], uint32(c.counter))
+	if last {
+		n[len(n)-1] = 1
+	}
+	c.counter++
+
+	return n, nil
+}
+
+// encryptWriter encrypts a stream one segment at a time. It always holds back
+// the latest full segment, because it can't know whether that segment is the
+// last one until either more data arrives or Close is called.
+type encryptWriter struct {
+	streamCipher
+	w      io.Writer
+	buf    []byte
+	closed bool
+}
+
+// NewEncryptWriter writes the header of an AlgAES256GCMStream envelope to w
+// and returns a WriteCloser that encrypts meta, which may be nil, and then
+// everything written to it under key. id is bound as associated data just like
+// a Document's ID. Close must be called to write the final segment; it doesn't
+// close w.
+func NewEncryptWriter(w io.Writer, id uuid.UUID, key []byte, meta *Metadata) (io.WriteCloser, error) {
+	return newEncryptWriter(w, id, key, KDFNone, nil, meta)
+}
+
+// NewPassphraseEncryptWriter is like NewEncryptWriter, but stretches
+// passphrase into the key using DefaultKDFPolicy.
+func NewPassphraseEncryptWriter(w io.Writer, id uuid.UUID, passphrase []byte, meta *Metadata) (io.WriteCloser, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("Tried to encrypt a stream with an empty passphrase")
+	}
+
+	policy := DefaultKDFPolicy
+	params, key, err := policy.newKDFParams(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return newEncryptWriter(w, id, key, policy.KDF, params, meta)
+}
+
+func newEncryptWriter(w io.Writer, id uuid.UUID, key []byte, kdf KDF, kdfParams []byte, meta *Metadata) (*encryptWriter, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, streamNoncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+
+	e := &Envelope{
+		Version:   EnvelopeVersion,
+		Algorithm: AlgAES256GCMStream,
+		KDF:       kdf,
+		KDFParams: kdfParams,
+		Nonce:     prefix,
+	}
+
+	header, err := e.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	d := &Document{ID: id}
+
+	s := &encryptWriter{
+		streamCipher: streamCipher{
+			aead:   aead,
+			prefix: prefix,
+			ad:     d.associatedData(e),
+		},
+		w:   w,
+		buf: make([]byte, 0, StreamSegmentSize),
+	}
+
+	section, err := appendMetadata(nil, meta)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := s.Write(section); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *encryptWriter) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("write to closed stream")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		if len(s.buf) == StreamSegmentSize {
+			// More data is coming, so the buffered segment isn't the last.
+			if err := s.flush(false); err != nil {
+				return n, err
+			}
+		}
+
+		c := copy(s.buf[len(s.buf):StreamSegmentSize], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+		n += c
+	}
+
+	return n, nil
+}
+
+// Close seals and writes the final segment.
+func (s *encryptWriter) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+
+	return s.flush(true)
+}
+
+func (s *encryptWriter) flush(last bool) error {
+	nonce, err := s.nonce(last)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.w.Write(s.aead.Seal(nil, nonce, s.buf, s.ad)); err != nil {
+		return err
+	}
+	s.buf = s.buf[:0]
+
+	return nil
+}
+
+// decryptReader authenticates and decrypts a stream one segment at a time, so
+// it never returns plaintext that hasn't been verified.
+type decryptReader struct {
+	streamCipher
+	r     *bufio.Reader
+	seg   []byte
+	plain []byte
+	done  bool
+	err   error
+}
+
+// NewDecryptReader reads the header of an AlgAES256GCMStream envelope from r,
+// decrypts the stream's metadata and returns it along with a Reader of the
+// rest of the decrypted stream. key is stretched first if the header says the
+// stream was encrypted with a passphrase. Since the metadata is in the first
+// segment, a wrong key is reported as ErrDecrypt here; after that, reads
+// return ErrDecrypt if any segment fails authentication or the stream is
+// truncated.
+func NewDecryptReader(r io.Reader, id uuid.UUID, key []byte) (*Metadata, io.Reader, error) {
+	e, err := ReadEnvelopeHeader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if e.Algorithm != AlgAES256GCMStream {
+		return nil, nil, ErrUnsupportedEnvelope
+	}
+	if len(e.Nonce) != streamNoncePrefixSize {
+		return nil, nil, ErrMalformedEnvelope
+	}
+
+	key, err = envelopeKey(e, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, nil, ErrDecrypt
+	}
+
+	d := &Document{ID: id}
+
+	s := &decryptReader{
+		streamCipher: streamCipher{
+			aead:   aead,
+			prefix: e.Nonce,
+			ad:     d.associatedData(e),
+		},
+		r:   bufio.NewReader(r),
+		seg: make([]byte, StreamSegmentSize+aead.Overhead()),
+	}
+
+	if e.Version < metadataVersion {
+		return &Metadata{}, s, nil
+	}
+
+	m, err := readMetadata(s)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return m, s, nil
+}
+
+func (s *decryptReader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		s.err = s.next()
+	}
+
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+
+	return n, nil
+}
+
+// next reads and opens the following segment.
+func (s *decryptReader) next() error {
+	n, err := io.ReadFull(s.r, s.seg)
+	switch err {
+	case nil:
+		// A full segment is the last one only if nothing follows it.
+		if _, err := s.r.Peek(1); err == io.EOF {
+			s.done = true
+		} else if err != nil {
+			return err
+		}
+	case io.ErrUnexpectedEOF:
+		s.done = true
+	case io.EOF:
+		// The previous segment wasn't marked final, so the stream was cut short.
+		return ErrDecrypt
+	default:
+		return err
+	}
+
+	nonce, err := s.nonce(s.done)
+	if err != nil {
+		return err
+	}
+
+	plain, err := s.aead.Open(s.seg[:0], nonce, s.seg[:n], s.ad)
+	if err != nil {
+		return ErrDecrypt
+	}
+	s.plain = plain
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package pasteburn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	uuid "github.com/nu7hatch/gouuid"
+)
+
+func encryptStream(t *testing.T, id uuid.UUID, key, plaintext []byte) []byte {
+	var buf bytes.Buffer
+	w, err := NewEncryptWriter(&buf, id, key, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd-sized writes make sure segment boundaries don't depend on how callers write.
+	for p := plaintext; len(p) > 0; {
+		n := 1000
+		if n > len(p) {
+			n = len(p)
+		}
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	key := []byte("11112222333344445555666677778888")
+	id, _ := uuid.NewV4()
+
+	for _, size := range []int{0, 1, StreamSegmentSize - 1, StreamSegmentSize, StreamSegmentSize + 1, 3*StreamSegmentSize + 17} {
+		plaintext := make([]byte, size)
+		rand.Read(plaintext)
+
+		ciphertext := encryptStream(t, *id, key, plaintext)
+
+		_, r, err := NewDecryptReader(bytes.NewReader(ciphertext), *id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if !bytes.Equal(got, plaintext) {
+			t.Errorf("size %d: stream didn't round trip", size)
+		}
+
+		// Whole-document decryption understands streams too.
+		d := &Document{ID: *id, Contents: ciphertext}
+		if err := d.DecryptInPlace(key); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(d.Contents, plaintext) {
+			t.Errorf("size %d: DecryptInPlace didn't round trip", size)
+		}
+	}
+}
+
+// Truncating at a segment boundary, swapping segments or using the wrong key must all fail.
+func TestStreamTampering(t *testing.T) {
+	key := []byte("11112222333344445555666677778888")
+	id, _ := uuid.NewV4()
+
+	plaintext := make([]byte, 3*StreamSegmentSize)
+	rand.Read(plaintext)
+	ciphertext := encryptStream(t, *id, key, plaintext)
+
+	e, err := ReadEnvelopeHeader(bytes.NewReader(ciphertext))
+	if err != nil {
+		t.Fatal(err)
+	}
+	headerLen := len(e.Header())
+	segLen := StreamSegmentSize + 16
+
+	read := func(b []byte, k []byte) error {
+		_, r, err := NewDecryptReader(bytes.NewReader(b), *id, k)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(ioutil.Discard, r)
+		return err
+	}
+
+	truncated := ciphertext[:headerLen+2*segLen]
+	if err := read(truncated, key); err != ErrDecrypt {
+		t.Errorf("Truncated stream: expected ErrDecrypt, got %v", err)
+	}
+
+	swapped := append([]byte{}, ciphertext...)
+	copy(swapped[headerLen:], ciphertext[headerLen+segLen:headerLen+2*segLen])
+	copy(swapped[headerLen+segLen:], ciphertext[headerLen:headerLen+segLen])
+	if err := read(swapped, key); err != ErrDecrypt {
+		t.Errorf("Swapped segments: expected ErrDecrypt, got %v", err)
+	}
+
+	if err := read(ciphertext, []byte("AAAABBBBCCCCDDDDEEEEFFFFGGGGHHHH")); err != ErrDecrypt {
+		t.Errorf("Wrong key: expected ErrDecrypt, got %v", err)
+	}
+
+	other, _ := uuid.NewV4()
+	if _, _, err := NewDecryptReader(bytes.NewReader(ciphertext), *other, key); err != ErrDecrypt {
+		t.Errorf("Wrong ID: expected ErrDecrypt, got %v", err)
+	}
+}
+
+func TestStreamPassphrase(t *testing.T) {
+	defer cheapKDFPolicy(KDFArgon2id)()
+
+	d, err := NewDocumentFromReader(bytes.NewReader([]byte("secret")), []byte("hunter2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DecryptInPlace([]byte("hunter2")); err != nil {
+		t.Fatal(err)
+	}
+	if string(d.Contents) != "secret" {
+		t.Errorf("Stream document decrypted to %q", d.Contents)
+	}
+}
@@ -1,11 +1,17 @@
 package pasteburn
 
 import (
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"sort"
 	"strconv"
+	"time"
 
 	uuid "github.com/nu7hatch/gouuid"
 
@@ -22,23 +28,105 @@ func MakeTextAddHandler(ctx context.Context, s Service) http.HandlerFunc {
 			body, err := ioutil.ReadAll(r.Body)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 
 			var req struct {
-				Body string
-				Key  string
+				Body        string
+				Key         string
+				GenerateKey bool
+				Reads       string
+				TTL         string
+				Title       string
+				Note        string
+				// Recipient is an X25519 public key, encoded like a share
+				// key. Only its private key can decrypt the document, so it's
+				// read back through the blob view and decrypted by the client.
+				Recipient string
 			}
 
 			if err := json.Unmarshal(body, &req); err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 
-			d, err := NewDocument([]byte(req.Body), []byte(req.Key))
+			reads, err := parseReads(req.Reads)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			expires, err := parseTTL(req.TTL)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			id, err := uuid.NewV4()
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			d := &Document{
+				ID:       *id,
+				Contents: []byte(req.Body),
+				Metadata: Metadata{
+					Title: req.Title,
+					Note:  req.Note,
+				},
+				Reads:   reads,
+				Expires: expires,
 			}
 
-			err = s.PostDocument(ctx, d)
+			var key []byte
+			if req.Recipient != "" {
+				public, err := DecodeShareKey(req.Recipient)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if err := d.EncryptToRecipient(public); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			} else if req.GenerateKey {
+				if key, err = GenerateKey(); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				if err := d.EncryptInPlace(key); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			} else if err := d.EncryptWithPassphrase([]byte(req.Key)); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			// Only the recipient can decrypt it, so it's read back as a blob.
+			post := s.PostDocument
+			if req.Recipient != "" {
+				post = s.PostBlob
+			}
+			if err := post(ctx, d); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if req.Recipient != "" {
+				json.NewEncoder(w).Encode(&struct {
+					ID  string `json:"id"`
+					URL string `json:"url"`
+				}{
+					ID:  d.ID.String(),
+					URL: ShareURL(shareBase(r), "/api/blob/view", d.ID, nil),
+				})
+				return
+			}
+			if req.GenerateKey {
+				writeShareLink(w, r, "/api/text/view", d.ID, key)
+				return
+			}
 
 			json.NewEncoder(w).Encode(d)
 		}
@@ -54,19 +142,32 @@ func MakeTextViewHandler(ctx context.Context, s Service) http.HandlerFunc {
 			query := r.URL.Query()
 			id, err := uuid.ParseHex(query.Get("id"))
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
 
-			key := []byte(query.Get("key"))
+			key, err := requestKey(query)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 
 			d, err := s.GetDocument(ctx, *id, key)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
 
 			json.NewEncoder(w).Encode(&struct {
-				id   string
-				body string
+				ID    string `json:"id"`
+				Body  string `json:"body"`
+				Title string `json:"title,omitempty"`
+				Note  string `json:"note,omitempty"`
 			}{
-				id:   d.ID.String(),
-				body: string(d.Contents),
+				ID:    d.ID.String(),
+				Body:  string(d.Contents),
+				Title: d.Metadata.Title,
+				Note:  d.Metadata.Note,
 			})
 		}
 	}
@@ -82,34 +183,109 @@ func MakeMultiTextAddHandler(ctx context.Context, s Service) http.HandlerFunc {
 			body, err := ioutil.ReadAll(r.Body)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 
+			// With Threshold set, the copies are Shamir shares of the key Body
+			// is encrypted under, and are read back with the combine endpoint.
+			// Labels name the recipient of each copy, in order.
 			var req struct {
-				Body  string
-				Key   string
-				Count string
+				Body      string
+				Key       string
+				Count     string
+				Threshold string
+				Labels    []string
+				Reads     string
+				TTL       string
 			}
 
 			if err := json.Unmarshal(body, &req); err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 
-			count, err := strconv.ParseInt(req.Count, 10, 8)
+			count, err := strconv.ParseUint(req.Count, 10, 32)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if count < 1 {
+				http.Error(w, "at least one copy is required", http.StatusBadRequest)
+				return
+			}
+			if count > MaxMultiDocCopies {
+				http.Error(w, "too many copies", http.StatusBadRequest)
+				return
 			}
 
-			md, keys, err := NewMultiDoc([]byte(req.Body), []byte(req.Key), byte(count))
+			reads, err := parseReads(req.Reads)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			expires, err := parseTTL(req.TTL)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			var (
+				md   *MultiDoc
+				keys [][]byte
+			)
+			if req.Threshold != "" {
+				threshold, err := strconv.ParseUint(req.Threshold, 10, 8)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if count > MaxShares {
+					http.Error(w, "too many shares", http.StatusBadRequest)
+					return
+				}
+				md, keys, err = NewShamirMultiDoc([]byte(req.Body), byte(threshold), byte(count))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			} else {
+				md, keys, err = NewMultiDoc([]byte(req.Body), []byte(req.Key), uint32(count))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			md.Reads = reads
+			md.Expires = expires
+
+			if len(req.Labels) > len(md.Documents) {
+				http.Error(w, "more labels than copies", http.StatusBadRequest)
+				return
+			}
+			md.Labels = make(map[uint32]string)
+			for i, label := range req.Labels {
+				md.Labels[uint32(i)] = label
+			}
+
+			token, err := md.NewStatusToken()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 
 			if err := s.PostMultiDoc(ctx, md); err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 
 			res := struct {
-				ID   string   `json:"id"`
-				Keys [][]byte `json:"keys"`
+				ID          string   `json:"id"`
+				Keys        [][]byte `json:"keys"`
+				StatusToken string   `json:"statusToken"`
 			}{
-				ID: md.ID.String(),
+				ID:          md.ID.String(),
+				StatusToken: EncodeShareKey(token),
 			}
 			for _, key := range keys {
 				res.Keys = append(res.Keys, key)
@@ -129,17 +305,20 @@ func MakeMultiTextViewHandler(ctx context.Context, s Service) http.HandlerFunc {
 			query := r.URL.Query()
 			id, err := uuid.ParseHex(query.Get("id"))
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
 
 			key, err := base64.StdEncoding.DecodeString(query.Get("key"))
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
 
 			d, err := s.GetMultiDoc(ctx, *id, key)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				writeError(w, err)
+				return
 			}
 
 			json.NewEncoder(w).Encode(struct {
@@ -153,32 +332,192 @@ func MakeMultiTextViewHandler(ctx context.Context, s Service) http.HandlerFunc {
 	}
 }
 
-// MakeImageAddHandler returns a handler that uses a Service to serve add requests
+// MakeMultiStatusHandler returns a handler that uses a Service to serve
+// multidoc status requests from whoever holds the status token
+func MakeMultiStatusHandler(ctx context.Context, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+		} else {
+			query := r.URL.Query()
+			id, err := uuid.ParseHex(query.Get("id"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			token, err := DecodeShareKey(query.Get("token"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			st, err := s.GetMultiDocStatus(ctx, *id, token)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			type copyStatus struct {
+				Index    int        `json:"index"`
+				Label    string     `json:"label,omitempty"`
+				Reads    int        `json:"reads"`
+				LastRead *time.Time `json:"lastRead,omitempty"`
+				Burned   bool       `json:"burned"`
+			}
+			res := struct {
+				ID      string       `json:"id"`
+				Expires *time.Time   `json:"expires,omitempty"`
+				Expired bool         `json:"expired"`
+				Copies  []copyStatus `json:"copies"`
+			}{
+				ID:      id.String(),
+				Expired: st.Expired,
+				Copies:  []copyStatus{},
+			}
+			if !st.Expires.IsZero() {
+				res.Expires = &st.Expires
+			}
+			for idx, c := range st.Copies {
+				cs := copyStatus{
+					Index:  int(idx),
+					Label:  c.Label,
+					Reads:  c.Reads,
+					Burned: c.Burned,
+				}
+				if !c.LastRead.IsZero() {
+					lastRead := c.LastRead
+					cs.LastRead = &lastRead
+				}
+				res.Copies = append(res.Copies, cs)
+			}
+			sort.Slice(res.Copies, func(i, j int) bool { return res.Copies[i].Index < res.Copies[j].Index })
+
+			json.NewEncoder(w).Encode(&res)
+		}
+	}
+}
+
+// MakeMultiCombineHandler returns a handler that uses a Service to serve
+// requests that reconstruct a secret from the shares of a Shamir multidoc
+func MakeMultiCombineHandler(ctx context.Context, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+		} else {
+			var req struct {
+				ID   string
+				Keys [][]byte
+			}
+
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			id, err := uuid.ParseHex(req.ID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			body, err := s.CombineShares(ctx, *id, req.Keys)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			json.NewEncoder(w).Encode(struct {
+				ID   string `json:"id"`
+				Body string `json:"body"`
+			}{
+				ID:   id.String(),
+				Body: string(body),
+			})
+		}
+	}
+}
+
+// MakeImageAddHandler returns a handler that uses a Service to serve add requests.
+// Images are stored like files, with PostFile, so they're encrypted and saved
+// in segments as they're read from the parsed form rather than held in full.
 func MakeImageAddHandler(ctx context.Context, s Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			http.Error(w, "", http.StatusMethodNotAllowed)
 		} else {
-			key := r.FormValue("key")
+			key := []byte(r.FormValue("key"))
+			generate := r.FormValue("generateKey") == "true"
 
-			file, _, err := r.FormFile("image")
+			reads, err := parseReads(r.FormValue("reads"))
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
 
-			rawImage, err := ioutil.ReadAll(file)
+			expires, err := parseTTL(r.FormValue("ttl"))
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
 			}
 
-			d, err := NewDocument(rawImage, []byte(key))
+			file, header, err := r.FormFile("image")
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
+			defer file.Close()
 
-			err = s.PostDocument(ctx, d)
+			// The type is sniffed from the first bytes when the image is
+			// stored, since nothing can look at it once it's encrypted.
+			head := make([]byte, 512)
+			n, err := io.ReadFull(file, head)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			head = head[:n]
+
+			id, err := uuid.NewV4()
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			d := &Document{
+				ID: *id,
+				Metadata: Metadata{
+					Type: http.DetectContentType(head),
+					Size: header.Size,
+				},
+				Encrypted: true,
+				Reads:     reads,
+				Expires:   expires,
+			}
+
+			encrypter := func(w io.Writer, id uuid.UUID) (io.WriteCloser, error) {
+				return NewPassphraseEncryptWriter(w, id, key, &d.Metadata)
+			}
+			if generate {
+				if key, err = GenerateKey(); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				encrypter = func(w io.Writer, id uuid.UUID) (io.WriteCloser, error) {
+					return NewEncryptWriter(w, id, key, &d.Metadata)
+				}
+			} else if len(key) == 0 {
+				http.Error(w, "key is required", http.StatusBadRequest)
+				return
+			}
+
+			if err := PostFile(ctx, s, d, io.MultiReader(bytes.NewReader(head), file), encrypter); err != nil {
+				writeError(w, err)
+				return
+			}
+
+			if generate {
+				writeShareLink(w, r, "/api/image/view", d.ID, key)
+				return
 			}
 
 			json.NewEncoder(w).Encode(d)
@@ -186,7 +525,8 @@ func MakeImageAddHandler(ctx context.Context, s Service) http.HandlerFunc {
 	}
 }
 
-// MakeImageViewHandler returns a handler that uses a Service to serve view requests
+// MakeImageViewHandler returns a handler that uses a Service to serve view requests.
+// Images stored before they were streams are still served from documents.
 func MakeImageViewHandler(ctx context.Context, s Service) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "GET" {
@@ -194,21 +534,289 @@ func MakeImageViewHandler(ctx context.Context, s Service) http.HandlerFunc {
 		} else {
 			query := r.URL.Query()
 			id, err := uuid.ParseHex(query.Get("id"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			key, err := requestKey(query)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			m, rc, err := s.GetStream(ctx, *id, key)
+			if err == ErrNotFound {
+				d, err := s.GetDocument(ctx, *id, key)
+				if err != nil {
+					writeError(w, err)
+					return
+				}
+
+				w.Header().Set("Content-Type", http.DetectContentType(d.Contents))
+				w.Header().Set("Content-Length", strconv.Itoa(len(d.Contents)))
+				w.Write(d.Contents)
+				return
+			}
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			defer rc.Close()
+
+			w.Header().Set("Content-Type", m.Type)
+			w.Header().Set("Content-Length", strconv.FormatInt(m.Size, 10))
+
+			copyStream(w, rc)
+		}
+	}
+}
+
+// MakeBlobAddHandler returns a handler that stores a client-encrypted request body as-is.
+func MakeBlobAddHandler(ctx context.Context, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+		} else {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if len(body) == 0 {
+				http.Error(w, "empty blob", http.StatusBadRequest)
+				return
+			}
+
+			reads, err := parseReads(r.URL.Query().Get("reads"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			expires, err := parseTTL(r.URL.Query().Get("ttl"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			d, err := NewBlob(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			d.Reads = reads
+			d.Expires = expires
+
+			if err := s.PostBlob(ctx, d); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			json.NewEncoder(w).Encode(d)
+		}
+	}
+}
+
+// MakeBlobViewHandler returns a handler that serves a client-encrypted blob verbatim.
+func MakeBlobViewHandler(ctx context.Context, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+		} else {
+			id, err := uuid.ParseHex(r.URL.Query().Get("id"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			d, err := s.GetBlob(ctx, *id)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", strconv.Itoa(len(d.Contents)))
+
+			w.Write(d.Contents)
+		}
+	}
+}
+
+// MakeFileAddHandler returns a handler that stores a raw request body as a file.
+// The file's MIME type is taken from the Content-Type header and its name from
+// the filename parameter of a Content-Disposition header; both are encrypted
+// with the file. The body is encrypted and stored as it's read, so the request
+// must declare its Content-Length.
+func MakeFileAddHandler(ctx context.Context, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+		} else {
+			if r.ContentLength < 0 {
+				http.Error(w, "", http.StatusLengthRequired)
+				return
+			}
+
+			query := r.URL.Query()
+			generate := query.Get("generateKey") == "true"
+
+			reads, err := parseReads(query.Get("reads"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			expires, err := parseTTL(query.Get("ttl"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			id, err := uuid.NewV4()
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			d := &Document{
+				ID: *id,
+				Metadata: Metadata{
+					Type: DefaultFileType,
+					Size: r.ContentLength,
+				},
+				Encrypted: true,
+				Reads:     reads,
+				Expires:   expires,
+			}
+			if t, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil {
+				if t = mime.FormatMediaType(t, params); t != "" {
+					d.Metadata.Type = t
+				}
+			}
+			if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Disposition")); err == nil {
+				d.Metadata.Name = cleanFileName(params["filename"])
 			}
 
 			key := []byte(query.Get("key"))
+			encrypter := func(w io.Writer, id uuid.UUID) (io.WriteCloser, error) {
+				return NewPassphraseEncryptWriter(w, id, key, &d.Metadata)
+			}
+			if generate {
+				if key, err = GenerateKey(); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				encrypter = func(w io.Writer, id uuid.UUID) (io.WriteCloser, error) {
+					return NewEncryptWriter(w, id, key, &d.Metadata)
+				}
+			} else if len(key) == 0 {
+				http.Error(w, "key is required", http.StatusBadRequest)
+				return
+			}
 
-			d, err := s.GetDocument(ctx, *id, key)
+			if err := PostFile(ctx, s, d, r.Body, encrypter); err != nil {
+				writeError(w, err)
+				return
+			}
+
+			if generate {
+				writeShareLink(w, r, "/api/file/view", d.ID, key)
+				return
+			}
+
+			json.NewEncoder(w).Encode(d)
+		}
+	}
+}
+
+// MakeFileViewHandler returns a handler that serves a file as a download with
+// the name and MIME type it was uploaded with.
+func MakeFileViewHandler(ctx context.Context, s Service) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "", http.StatusMethodNotAllowed)
+		} else {
+			query := r.URL.Query()
+			id, err := uuid.ParseHex(query.Get("id"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			key, err := requestKey(query)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
 
-			rawData := d.Contents
-			contentType := http.DetectContentType(rawData)
+			m, rc, err := s.GetStream(ctx, *id, key)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			defer rc.Close()
+
+			contentType := m.Type
+			if contentType == "" {
+				contentType = DefaultFileType
+			}
+
+			disposition := mime.FormatMediaType("attachment", map[string]string{"filename": m.Name})
+			if m.Name == "" || disposition == "" {
+				disposition = "attachment"
+			}
 
 			w.Header().Set("Content-Type", contentType)
-			w.Header().Set("Content-Length", string(len(d.Contents)))
+			w.Header().Set("Content-Length", strconv.FormatInt(m.Size, 10))
+			w.Header().Set("Content-Disposition", disposition)
+			// The type is whatever the uploader declared, so browsers mustn't second-guess it.
+			w.Header().Set("X-Content-Type-Options", "nosniff")
 
-			w.Write(rawData)
+			copyStream(w, rc)
 		}
 	}
 }
+
+// copyStream copies a decrypted stream into a response whose status has
+// already been sent. A failure partway, such as a segment failing
+// authentication, can't change the status any more, so the connection is
+// reset rather than letting the client take a cut-off body for the whole.
+// Streams from GetStream log their own failures.
+func copyStream(w io.Writer, r io.Reader) {
+	if _, err := io.Copy(w, r); err != nil {
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// parseReads parses the optional "reads" parameter of create requests.
+// An empty value means the document burns on the first read.
+func parseReads(v string) (int, error) {
+	if v == "" {
+		return 1, nil
+	}
+
+	reads, err := strconv.ParseUint(v, 10, 31)
+	if err != nil || reads == 0 {
+		return 0, errors.New("reads must be a positive integer")
+	}
+
+	return int(reads), nil
+}
+
+// parseTTL parses the optional "ttl" parameter of create requests, a Go
+// duration such as "1h30m", into an expiry time. An empty value means the
+// document only expires if the server imposes a maximum.
+func parseTTL(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+
+	ttl, err := time.ParseDuration(v)
+	if err != nil || ttl <= 0 {
+		return time.Time{}, errors.New("ttl must be a positive duration such as \"24h\"")
+	}
+
+	return time.Now().Add(ttl), nil
+}